@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const APIPrefix = "/api/v1"
+const PostsPageSize = 20
+const MaxPostsPageSize = 100
+
+type APIError struct {
+	Code    string
+	Message string
+}
+
+type APIErrorResponse struct {
+	Error APIError
+}
+
+// ChannelInput is the body of the channel create and update requests. It has the same
+// fields as a channel in responses, so a fetched channel may be sent back modified.
+// Request settings are kept as is on update if they are omitted.
+// Author is who changes the rule, it is kept in the rule history.
+// A non-zero RuleID makes the channel use the rule template instead of its own Rule.
+type ChannelInput struct {
+	Name            string
+	Source          string
+	RefreshInterval Duration
+	Rule            Rule
+	RuleID          uint
+	RequestConfig   *RequestConfig
+	Author          string
+}
+
+func (input *ChannelInput) channel() Channel {
+	channel := Channel{
+		Name:            input.Name,
+		Source:          input.Source,
+		RefreshInterval: input.RefreshInterval.Duration,
+		Rule:            input.Rule,
+		RuleID:          input.RuleID,
+	}
+	if input.RequestConfig != nil {
+		channel.RequestConfig = *input.RequestConfig
+	}
+	return channel
+}
+
+// ChannelOutput is a channel in responses with intervals written like "1h30m",
+// as in the config and the forms.
+type ChannelOutput struct {
+	Channel
+	RefreshInterval  Duration
+	AdaptiveInterval Duration
+}
+
+func newChannelOutput(channel *Channel) ChannelOutput {
+	return ChannelOutput{
+		Channel:          *channel,
+		RefreshInterval:  Duration{channel.RefreshInterval},
+		AdaptiveInterval: Duration{channel.AdaptiveInterval},
+	}
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	rawValue, err := json.Marshal(value)
+	if err != nil {
+		log.Println("api error, marshalling response: " + err.Error())
+		status = http.StatusInternalServerError
+		rawValue, _ = json.Marshal(APIErrorResponse{Error: APIError{Code: "internal_error", Message: "marshalling error"}})
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(rawValue)
+}
+
+func writeAPIError(writer http.ResponseWriter, status int, code, message string) {
+	writeJSON(writer, status, APIErrorResponse{Error: APIError{Code: code, Message: message}})
+}
+
+// writeDBError chooses the response status by the type of the DBApi error.
+func writeDBError(writer http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *NotFoundError:
+		writeAPIError(writer, http.StatusNotFound, "not_found", err.Error())
+	case *ValidationError:
+		writeAPIError(writer, http.StatusBadRequest, "validation_error", err.Error())
+	default:
+		log.Println("api error: " + err.Error())
+		writeAPIError(writer, http.StatusInternalServerError, "internal_error", "internal server error")
+	}
+}
+
+func writeMethodNotAllowed(writer http.ResponseWriter, allowed ...string) {
+	writer.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAPIError(writer, http.StatusMethodNotAllowed, "method_not_allowed", "allowed methods are "+strings.Join(allowed, ", "))
+}
+
+func readChannelInput(writer http.ResponseWriter, request *http.Request) (*ChannelInput, bool) {
+	var input ChannelInput
+	err := json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, "bad_request", "decoding channel error: "+err.Error())
+		return nil, false
+	}
+	return &input, true
+}
+
+// ChannelsAPIHandler serves /api/v1/channels, /api/v1/channels/{id} and /api/v1/channels/{id}/posts.
+func ChannelsAPIHandler(writer http.ResponseWriter, request *http.Request) {
+	path := strings.Trim(request.URL.Path[len(APIPrefix+"/channels"):], "/")
+	if path == "" {
+		switch request.Method {
+		case http.MethodGet:
+			listChannels(writer)
+		case http.MethodPost:
+			createChannel(writer, request)
+		default:
+			writeMethodNotAllowed(writer, http.MethodGet, http.MethodPost)
+		}
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	channelId, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, "bad_request", "bad channel id '"+parts[0]+"'")
+		return
+	}
+	if len(parts) == 2 && parts[1] == "posts" {
+		listPosts(writer, request, uint(channelId))
+		return
+	}
+	if len(parts) > 1 {
+		writeAPIError(writer, http.StatusNotFound, "not_found", "unknown resource "+request.URL.Path)
+		return
+	}
+	switch request.Method {
+	case http.MethodGet:
+		getChannel(writer, uint(channelId))
+	case http.MethodPut:
+		updateChannel(writer, request, uint(channelId))
+	case http.MethodDelete:
+		deleteChannel(writer, uint(channelId))
+	default:
+		writeMethodNotAllowed(writer, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func listChannels(writer http.ResponseWriter) {
+	output := []ChannelOutput{}
+	for _, channel := range dbApi.ListChannels() {
+		output = append(output, newChannelOutput(&channel))
+	}
+	writeJSON(writer, http.StatusOK, output)
+}
+
+func getChannel(writer http.ResponseWriter, channelId uint) {
+	channel, err := dbApi.GetChannelById(channelId)
+	if err != nil {
+		writeDBError(writer, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, newChannelOutput(channel))
+}
+
+func createChannel(writer http.ResponseWriter, request *http.Request) {
+	input, ok := readChannelInput(writer, request)
+	if !ok {
+		return
+	}
+	channel, err := dbApi.CreateChannel(input.channel())
+	if err != nil {
+		writeDBError(writer, err)
+		return
+	}
+	channelsUpdater.Wake()
+	writer.Header().Set("Location", fmt.Sprintf("%v/channels/%v", APIPrefix, channel.ID))
+	writeJSON(writer, http.StatusCreated, newChannelOutput(channel))
+}
+
+func updateChannel(writer http.ResponseWriter, request *http.Request, channelId uint) {
+	input, ok := readChannelInput(writer, request)
+	if !ok {
+		return
+	}
+	channel := input.channel()
+	channel.ID = channelId
+	updatedChannel, err := dbApi.UpdateChannel(channel, input.RequestConfig, input.Author)
+	if err != nil {
+		writeDBError(writer, err)
+		return
+	}
+	channelsUpdater.Wake()
+	writeJSON(writer, http.StatusOK, newChannelOutput(updatedChannel))
+}
+
+func deleteChannel(writer http.ResponseWriter, channelId uint) {
+	err := dbApi.DeleteChannel(channelId)
+	if err != nil {
+		writeDBError(writer, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// RuleInput is the body of the rule template create and update requests.
+type RuleInput struct {
+	Rule
+	Author string
+}
+
+func readRuleInput(writer http.ResponseWriter, request *http.Request) (*RuleInput, bool) {
+	var input RuleInput
+	err := json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, "bad_request", "decoding rule error: "+err.Error())
+		return nil, false
+	}
+	if strings.TrimSpace(input.Name) == "" {
+		writeAPIError(writer, http.StatusBadRequest, "validation_error", "rule template name should not be empty")
+		return nil, false
+	}
+	return &input, true
+}
+
+// RulesAPIHandler serves /api/v1/rules and /api/v1/rules/{id} with the rule templates.
+func RulesAPIHandler(writer http.ResponseWriter, request *http.Request) {
+	path := strings.Trim(request.URL.Path[len(APIPrefix+"/rules"):], "/")
+	if path == "" {
+		switch request.Method {
+		case http.MethodGet:
+			writeJSON(writer, http.StatusOK, dbApi.ListRuleTemplates())
+		case http.MethodPost:
+			createRuleTemplate(writer, request)
+		default:
+			writeMethodNotAllowed(writer, http.MethodGet, http.MethodPost)
+		}
+		return
+	}
+
+	ruleId, err := strconv.ParseUint(path, 10, 32)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, "bad_request", "bad rule id '"+path+"'")
+		return
+	}
+	switch request.Method {
+	case http.MethodGet:
+		getRuleTemplate(writer, uint(ruleId))
+	case http.MethodPut:
+		updateRuleTemplate(writer, request, uint(ruleId))
+	default:
+		writeMethodNotAllowed(writer, http.MethodGet, http.MethodPut)
+	}
+}
+
+func getRuleTemplate(writer http.ResponseWriter, ruleId uint) {
+	rule, err := dbApi.GetRuleTemplate(ruleId)
+	if err != nil {
+		writeDBError(writer, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, rule)
+}
+
+func createRuleTemplate(writer http.ResponseWriter, request *http.Request) {
+	input, ok := readRuleInput(writer, request)
+	if !ok {
+		return
+	}
+	rule, err := dbApi.CreateRule(input.Rule)
+	if err != nil {
+		writeDBError(writer, err)
+		return
+	}
+	writer.Header().Set("Location", fmt.Sprintf("%v/rules/%v", APIPrefix, rule.ID))
+	writeJSON(writer, http.StatusCreated, rule)
+}
+
+func updateRuleTemplate(writer http.ResponseWriter, request *http.Request, ruleId uint) {
+	input, ok := readRuleInput(writer, request)
+	if !ok {
+		return
+	}
+	_, err := dbApi.GetRuleTemplate(ruleId)
+	if err != nil {
+		writeDBError(writer, err)
+		return
+	}
+	input.Rule.ID = ruleId
+	rule, err := dbApi.UpdateRule(input.Rule, input.Author)
+	if err != nil {
+		writeDBError(writer, err)
+		return
+	}
+	channelsUpdater.Wake()
+	writeJSON(writer, http.StatusOK, rule)
+}
+
+type PostsPage struct {
+	Posts      []Post
+	NextCursor string
+}
+
+// encodeCursor makes an opaque token of the cursor for the next page URL.
+func encodeCursor(cursor *PostsCursor) string {
+	if cursor == nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%v:%v", cursor.Date.UnixNano(), cursor.ID)))
+}
+
+func decodeCursor(token string) (*PostsCursor, error) {
+	rawCursor, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("bad cursor: " + err.Error())
+	}
+	parts := strings.Split(string(rawCursor), ":")
+	if len(parts) != 2 {
+		return nil, errors.New("bad cursor: unknown format")
+	}
+	date, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("bad cursor: " + err.Error())
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return nil, errors.New("bad cursor: " + err.Error())
+	}
+	return &PostsCursor{Date: time.Unix(0, date), ID: uint(id)}, nil
+}
+
+func parseQueryDate(name, value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		date, err := time.Parse(layout, value)
+		if err == nil {
+			return &date, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("bad %v date '%v', expected RFC 3339 or YYYY-MM-DD", name, value))
+}
+
+// postsQueryFromRequest reads the page size, cursor, filters and sort order of a posts request.
+func postsQueryFromRequest(request *http.Request) (*PostsQuery, error) {
+	values := request.URL.Query()
+	query := PostsQuery{Title: values.Get("title"), Limit: PostsPageSize}
+	if rawLimit := values.Get("limit"); rawLimit != "" {
+		limit, err := strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > MaxPostsPageSize {
+			return nil, errors.New(fmt.Sprintf("bad limit '%v', expected a number from 1 to %v", rawLimit, MaxPostsPageSize))
+		}
+		query.Limit = limit
+	}
+	switch values.Get("order") {
+	case "", "desc":
+	case "asc":
+		query.Ascending = true
+	default:
+		return nil, errors.New("bad order '" + values.Get("order") + "', expected asc or desc")
+	}
+	var err error
+	query.Since, err = parseQueryDate("since", values.Get("since"))
+	if err != nil {
+		return nil, err
+	}
+	query.Until, err = parseQueryDate("until", values.Get("until"))
+	if err != nil {
+		return nil, err
+	}
+	if token := values.Get("cursor"); token != "" {
+		query.After, err = decodeCursor(token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &query, nil
+}
+
+// listPosts writes a page of posts of the channel or of all channels if channelId is 0.
+func listPosts(writer http.ResponseWriter, request *http.Request, channelId uint) {
+	if request.Method != http.MethodGet {
+		writeMethodNotAllowed(writer, http.MethodGet)
+		return
+	}
+	query, err := postsQueryFromRequest(request)
+	if err != nil {
+		writeAPIError(writer, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if channelId != 0 {
+		_, err = dbApi.GetChannelById(channelId)
+		if err != nil {
+			writeDBError(writer, err)
+			return
+		}
+		query.ChannelID = channelId
+	}
+	posts, cursor, err := dbApi.QueryPosts(query)
+	if err != nil {
+		writeDBError(writer, err)
+		return
+	}
+	if posts == nil {
+		posts = []Post{}
+	}
+	writeJSON(writer, http.StatusOK, PostsPage{Posts: posts, NextCursor: encodeCursor(cursor)})
+}
+
+// PostsAPIHandler serves /api/v1/posts with posts of all channels.
+func PostsAPIHandler(writer http.ResponseWriter, request *http.Request) {
+	listPosts(writer, request, 0)
+}
@@ -2,36 +2,345 @@ package main
 
 import (
 	"log"
+	"net/url"
+	"sync"
 	"time"
 )
 
-type ChannelsUpdater struct {
-	CommonDelay        time.Duration
-	InterChannelsDelay time.Duration
-	DBApi              *DBApi
+type hostLimiter struct {
+	mutex sync.Mutex
+	limit int
+	slots map[string]chan struct{}
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, slots: make(map[string]chan struct{})}
+}
+
+func (limiter *hostLimiter) acquire(host string) {
+	limiter.mutex.Lock()
+	slots, ok := limiter.slots[host]
+	if !ok {
+		slots = make(chan struct{}, limiter.limit)
+		limiter.slots[host] = slots
+	}
+	limiter.mutex.Unlock()
+	slots <- struct{}{}
+}
+
+func (limiter *hostLimiter) release(host string) {
+	limiter.mutex.Lock()
+	slots := limiter.slots[host]
+	limiter.mutex.Unlock()
+	<-slots
+}
+
+func channelHost(channel *Channel) string {
+	source, err := url.Parse(channel.Source)
+	if err != nil {
+		return channel.Source
+	}
+	return source.Hostname()
 }
 
-func (cu *ChannelsUpdater) Update() {
-	channels := cu.DBApi.ListChannels()
+// interleaveByHost reorders channels round-robin by host, so that workers
+// don't all wait for the same host while the others are idle.
+func interleaveByHost(channels []Channel) []Channel {
+	var hosts []string
+	channelsByHost := make(map[string][]Channel)
 	for _, channel := range channels {
-		log.Printf("start update channel %v\n", channel.ID)
-		err := cu.DBApi.UpdateChannelContent(channel.ID)
-		if err != nil {
-			log.Println("updating error: " + err.Error())
-			err = cu.DBApi.MarkChannelAsBroken(channel.ID)
-			log.Printf("mark channel %v as broken", channel.ID)
-			if err != nil {
-				log.Println("marking channel as broken error: " + err.Error())
+		host := channelHost(&channel)
+		if _, ok := channelsByHost[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		channelsByHost[host] = append(channelsByHost[host], channel)
+	}
+	var result []Channel
+	for len(result) < len(channels) {
+		for _, host := range hosts {
+			if len(channelsByHost[host]) == 0 {
+				continue
 			}
+			result = append(result, channelsByHost[host][0])
+			channelsByHost[host] = channelsByHost[host][1:]
+		}
+	}
+	return result
+}
+
+const SchedulerMaxSleep = time.Minute
+const RefreshBackoffFactor = 1.5
+const RefreshSpeedupFactor = 2
+
+type ChannelsUpdater struct {
+	DefaultRefreshInterval   time.Duration
+	InterChannelsDelay       time.Duration
+	Workers                  int
+	WorkersPerHost           int
+	AdaptiveRefresh          bool
+	MinRefreshInterval       time.Duration
+	MaxRefreshInterval       time.Duration
+	FailuresToDegrade        int
+	FailuresToBreak          int
+	TemporaryFailuresToBreak int
+	SuccessesToRecover       int
+	BrokenRetryInterval      time.Duration
+	MaxBrokenRetryInterval   time.Duration
+	DBApi                    *DBApi
+	hostLimiter              *hostLimiter
+	wakeup                   chan struct{}
+	mutex                    sync.Mutex
+	inFlight                 map[uint]bool
+}
+
+func (cu *ChannelsUpdater) Init(dbApi *DBApi, config *UpdaterConfig) {
+	cu.DBApi = dbApi
+	cu.DefaultRefreshInterval = config.DefaultRefreshInterval.Duration
+	cu.InterChannelsDelay = config.InterChannelsDelay.Duration
+	cu.Workers = config.Workers
+	cu.WorkersPerHost = config.WorkersPerHost
+	cu.AdaptiveRefresh = config.AdaptiveRefresh
+	cu.MinRefreshInterval = config.MinRefreshInterval.Duration
+	cu.MaxRefreshInterval = config.MaxRefreshInterval.Duration
+	cu.FailuresToDegrade = config.FailuresToDegrade
+	cu.FailuresToBreak = config.FailuresToBreak
+	cu.TemporaryFailuresToBreak = config.TemporaryFailuresToBreak
+	cu.SuccessesToRecover = config.SuccessesToRecover
+	cu.BrokenRetryInterval = config.BrokenRetryInterval.Duration
+	cu.MaxBrokenRetryInterval = config.MaxBrokenRetryInterval.Duration
+	cu.hostLimiter = newHostLimiter(config.WorkersPerHost)
+	cu.wakeup = make(chan struct{}, 1)
+	cu.inFlight = make(map[uint]bool)
+}
+
+// Wake makes the scheduler look for due channels right now,
+// e.g. after a channel has been created.
+func (cu *ChannelsUpdater) Wake() {
+	select {
+	case cu.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// adaptiveBounds returns the bounds of the adaptive interval of the channel.
+// The own refresh interval of the channel is a floor, so that a channel
+// which is configured to be updated rarely is never updated more often.
+func (cu *ChannelsUpdater) adaptiveBounds(channel *Channel) (time.Duration, time.Duration) {
+	min, max := cu.MinRefreshInterval, cu.MaxRefreshInterval
+	if channel.RefreshInterval > min {
+		min = channel.RefreshInterval
+	}
+	if min > max {
+		max = min
+	}
+	return min, max
+}
+
+func (cu *ChannelsUpdater) refreshInterval(channel *Channel) time.Duration {
+	if cu.AdaptiveRefresh && channel.AdaptiveInterval > 0 {
+		min, max := cu.adaptiveBounds(channel)
+		switch {
+		case channel.AdaptiveInterval < min:
+			return min
+		case channel.AdaptiveInterval > max:
+			return max
+		}
+		return channel.AdaptiveInterval
+	}
+	if channel.RefreshInterval > 0 {
+		return channel.RefreshInterval
+	}
+	return cu.DefaultRefreshInterval
+}
+
+// adaptRefreshInterval backs off channels which produced nothing new and
+// speeds up channels where every fetched item was new, so some may have been missed.
+func adaptRefreshInterval(interval time.Duration, stats *FetchStats, min, max time.Duration) time.Duration {
+	switch {
+	case stats.NewCount == 0:
+		interval = time.Duration(float64(interval) * RefreshBackoffFactor)
+	case stats.NewCount >= stats.ParsedCount:
+		interval = interval / RefreshSpeedupFactor
+	}
+	if interval < min {
+		return min
+	}
+	if interval > max {
+		return max
+	}
+	return interval
+}
+
+// nextChannelHealth moves a channel between health states after an update attempt.
+// Failures degrade and then break a channel, a broken channel becomes degraded
+// after the first successful update and healthy after enough of them in a row.
+// Temporary errors degrade a healthy channel right away, but break it only
+// after many more of them in a row than other errors.
+func (cu *ChannelsUpdater) nextChannelHealth(health ChannelHealth, updateErr error) ChannelHealth {
+	if IsTemporaryError(updateErr) {
+		health.ConsecutiveTemporaryFailures++
+		health.ConsecutiveSuccesses = 0
+		health.LastError = updateErr.Error()
+		if health.ConsecutiveTemporaryFailures >= cu.TemporaryFailuresToBreak {
+			health.Health = ChannelBroken
+		} else if health.Health != ChannelBroken {
+			health.Health = ChannelDegraded
 		}
+	} else if updateErr != nil {
+		health.ConsecutiveFailures++
+		health.ConsecutiveSuccesses = 0
+		health.LastError = updateErr.Error()
+		switch {
+		case health.ConsecutiveFailures >= cu.FailuresToBreak:
+			health.Health = ChannelBroken
+		case health.ConsecutiveFailures >= cu.FailuresToDegrade:
+			health.Health = ChannelDegraded
+		}
+	} else {
+		health.ConsecutiveFailures = 0
+		health.ConsecutiveTemporaryFailures = 0
+		health.ConsecutiveSuccesses++
+		health.LastError = ""
+		if health.ConsecutiveSuccesses >= cu.SuccessesToRecover {
+			health.Health = ChannelHealthy
+		} else if health.Health == ChannelBroken {
+			health.Health = ChannelDegraded
+		}
+	}
+	if health.Health == "" {
+		health.Health = ChannelHealthy
+	}
+	return health
+}
+
+// brokenRetryInterval doubles the delay before the next attempt
+// with every failure of an already broken channel.
+func (cu *ChannelsUpdater) brokenRetryInterval(failures int) time.Duration {
+	interval := cu.BrokenRetryInterval
+	for i := cu.FailuresToBreak; i < failures && interval < cu.MaxBrokenRetryInterval; i++ {
+		interval *= 2
+	}
+	if interval > cu.MaxBrokenRetryInterval {
+		return cu.MaxBrokenRetryInterval
+	}
+	return interval
+}
+
+// brokenFailures returns the number of failures of the broken channel as if it was
+// broken by permanent errors, so that temporary errors back off the same way.
+func (cu *ChannelsUpdater) brokenFailures(health ChannelHealth) int {
+	temporaryFailures := health.ConsecutiveTemporaryFailures - cu.TemporaryFailuresToBreak + cu.FailuresToBreak
+	if temporaryFailures > health.ConsecutiveFailures {
+		return temporaryFailures
+	}
+	return health.ConsecutiveFailures
+}
+
+// dueChannels returns channels which should be updated at the moment
+// and the time when the next one of the rest becomes due.
+func dueChannels(channels []Channel, now time.Time, inFlight map[uint]bool) ([]Channel, time.Time) {
+	var due []Channel
+	nextWakeup := now.Add(SchedulerMaxSleep)
+	for _, channel := range channels {
+		if inFlight[channel.ID] {
+			continue
+		}
+		if channel.NextUpdateAt == nil || !channel.NextUpdateAt.After(now) {
+			due = append(due, channel)
+		} else if channel.NextUpdateAt.Before(nextWakeup) {
+			nextWakeup = *channel.NextUpdateAt
+		}
+	}
+	return due, nextWakeup
+}
+
+// failedUpdateInterval returns the delay before the next update after a failed one,
+// but never sooner than the source asked with Retry-After.
+func (cu *ChannelsUpdater) failedUpdateInterval(interval time.Duration, health ChannelHealth, err error) time.Duration {
+	if health.Health == ChannelBroken {
+		interval = cu.brokenRetryInterval(cu.brokenFailures(health))
+	} else if delay, ok := fetcher.RetryDelay(health.ConsecutiveTemporaryFailures, err); ok {
+		interval = delay
+	}
+	if retryAfter := RetryAfter(err); interval < retryAfter {
+		interval = retryAfter
+	}
+	return interval
+}
+
+func (cu *ChannelsUpdater) updateChannel(channel *Channel) {
+	host := channelHost(channel)
+	cu.hostLimiter.acquire(host)
+	defer cu.hostLimiter.release(host)
+
+	log.Printf("start update channel %v\n", channel.ID)
+	interval := cu.refreshInterval(channel)
+	stats, err := cu.DBApi.UpdateChannelContent(channel.ID)
+	health := cu.nextChannelHealth(channel.ChannelHealth, err)
+	if err != nil {
+		log.Println("updating error: " + err.Error())
+	} else if cu.AdaptiveRefresh && stats.HadPosts {
+		min, max := cu.adaptiveBounds(channel)
+		interval = adaptRefreshInterval(interval, stats, min, max)
+		log.Printf("channel %v got %v new posts of %v, next update in %v", channel.ID, stats.NewCount, stats.ParsedCount, interval)
+	}
+	var adaptiveInterval time.Duration
+	if cu.AdaptiveRefresh {
+		adaptiveInterval = interval
+	}
+	if err != nil {
+		interval = cu.failedUpdateInterval(interval, health, err)
+		log.Printf("channel %v failed, next update in %v", channel.ID, interval)
+	}
+	if health.Health != channel.Health {
+		log.Printf("channel %v is %v now", channel.ID, health.Health)
+	}
+	err = cu.DBApi.UpdateChannelHealth(channel.ID, channel.Revision, health)
+	if err != nil {
+		log.Println("updating health error: " + err.Error())
+	}
+	err = cu.DBApi.ScheduleChannelUpdate(channel.ID, channel.Revision, time.Now().Add(interval), adaptiveInterval)
+	if err != nil {
+		log.Println("scheduling error: " + err.Error())
+	}
+}
+
+func (cu *ChannelsUpdater) runWorker(jobs <-chan Channel) {
+	for channel := range jobs {
+		cu.updateChannel(&channel)
+		cu.mutex.Lock()
+		delete(cu.inFlight, channel.ID)
+		cu.mutex.Unlock()
+		cu.Wake()
+		// The host is released already, so the pause holds back only this worker.
 		time.Sleep(cu.InterChannelsDelay)
 	}
-	time.Sleep(cu.CommonDelay)
 }
 
-func RunUpdater(dbApi *DBApi, commonDelay, interChannelDelay time.Duration) {
-	channelsUpdater := ChannelsUpdater{DBApi: dbApi, CommonDelay: commonDelay, InterChannelsDelay: interChannelDelay}
+func (cu *ChannelsUpdater) Run() {
+	jobs := make(chan Channel)
+	for i := 0; i < cu.Workers; i++ {
+		go cu.runWorker(jobs)
+	}
 	for {
-		channelsUpdater.Update()
+		now := time.Now()
+		cu.mutex.Lock()
+		due, nextWakeup := dueChannels(cu.DBApi.ListDueChannels(now), now, cu.inFlight)
+		for _, channel := range due {
+			cu.inFlight[channel.ID] = true
+		}
+		cu.mutex.Unlock()
+		if nextUpdateAt := cu.DBApi.NextChannelUpdateAt(now); nextUpdateAt != nil && nextUpdateAt.Before(nextWakeup) {
+			nextWakeup = *nextUpdateAt
+		}
+
+		for _, channel := range interleaveByHost(due) {
+			jobs <- channel
+		}
+
+		select {
+		case <-time.After(time.Until(nextWakeup)):
+		case <-cu.wakeup:
+		}
 	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/net/html/charset"
+	"regexp"
+	"unicode/utf8"
+)
+
+const CharsetSniffSize = 1024
+
+var xmlEncodingPattern = regexp.MustCompile(`^\s*<\?xml[^>]*?\sencoding=["']([A-Za-z0-9._:-]+)["']`)
+
+// DetectCharset returns the name of the content charset. A byte order mark and
+// the Content-Type charset take precedence over the XML encoding declaration,
+// which takes precedence over HTML meta tags. Undeclared content is UTF-8 if it is valid UTF-8.
+func DetectCharset(content []byte, contentType string) string {
+	_, name, certain := charset.DetermineEncoding(content, contentType)
+	if certain {
+		return name
+	}
+	head := content
+	if len(head) > CharsetSniffSize {
+		head = head[:CharsetSniffSize]
+	}
+	if match := xmlEncodingPattern.FindSubmatch(head); match != nil {
+		if encoding, xmlName := charset.Lookup(string(match[1])); encoding != nil {
+			return xmlName
+		}
+	}
+	if utf8.Valid(content) {
+		return "utf-8"
+	}
+	return name
+}
+
+// DecodeContent transcodes content to UTF-8 and fixes its XML encoding
+// declaration, so that parsers don't try to transcode it once again.
+func DecodeContent(content []byte, contentType string) ([]byte, error) {
+	name := DetectCharset(content, contentType)
+	if name != "utf-8" {
+		encoding, _ := charset.Lookup(name)
+		if encoding == nil {
+			return nil, errors.New("unsupported charset " + name)
+		}
+		decoded, err := encoding.NewDecoder().Bytes(content)
+		if err != nil {
+			return nil, errors.New("decoding " + name + " content error: " + err.Error())
+		}
+		content = decoded
+	}
+	content = bytes.TrimPrefix(content, []byte("\uFEFF"))
+	if match := xmlEncodingPattern.FindSubmatchIndex(content); match != nil {
+		content = append(append(append([]byte{}, content[:match[2]]...), "UTF-8"...), content[match[3]:]...)
+	}
+	return content, nil
+}
@@ -4,10 +4,129 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"time"
 )
 
+const DefaultUserAgent = "Aggregator/1.0"
+
+type Duration struct {
+	time.Duration
+}
+
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var rawDuration string
+	err := json.Unmarshal(data, &rawDuration)
+	if err != nil {
+		return errors.New("duration should be a string like \"1h30m\": " + err.Error())
+	}
+	duration.Duration, err = time.ParseDuration(rawDuration)
+	return err
+}
+
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(duration.String())
+}
+
+type UpdaterConfig struct {
+	Workers                  int
+	WorkersPerHost           int
+	DefaultRefreshInterval   Duration
+	InterChannelsDelay       Duration
+	AdaptiveRefresh          bool
+	MinRefreshInterval       Duration
+	MaxRefreshInterval       Duration
+	FailuresToDegrade        int
+	FailuresToBreak          int
+	TemporaryFailuresToBreak int
+	SuccessesToRecover       int
+	BrokenRetryInterval      Duration
+	MaxBrokenRetryInterval   Duration
+}
+
+func (config *UpdaterConfig) setDefaults() {
+	if config.Workers <= 0 {
+		config.Workers = 4
+	}
+	if config.WorkersPerHost <= 0 {
+		config.WorkersPerHost = 1
+	}
+	if config.DefaultRefreshInterval.Duration == 0 {
+		config.DefaultRefreshInterval.Duration = time.Hour
+	}
+	if config.InterChannelsDelay.Duration == 0 {
+		config.InterChannelsDelay.Duration = time.Second * 3
+	}
+	if config.MinRefreshInterval.Duration == 0 {
+		config.MinRefreshInterval.Duration = time.Minute * 5
+	}
+	if config.MaxRefreshInterval.Duration == 0 {
+		config.MaxRefreshInterval.Duration = time.Hour * 24
+	}
+	if config.FailuresToDegrade <= 0 {
+		config.FailuresToDegrade = 1
+	}
+	if config.FailuresToBreak < config.FailuresToDegrade {
+		config.FailuresToBreak = config.FailuresToDegrade + 2
+	}
+	if config.TemporaryFailuresToBreak < config.FailuresToBreak {
+		config.TemporaryFailuresToBreak = config.FailuresToBreak * 4
+	}
+	if config.SuccessesToRecover <= 0 {
+		config.SuccessesToRecover = 2
+	}
+	if config.BrokenRetryInterval.Duration == 0 {
+		config.BrokenRetryInterval.Duration = time.Minute * 10
+	}
+	if config.MaxBrokenRetryInterval.Duration == 0 {
+		config.MaxBrokenRetryInterval.Duration = time.Hour * 24
+	}
+}
+
+type FetcherConfig struct {
+	ConnectTimeout   Duration
+	ReadTimeout      Duration
+	RequestTimeout   Duration
+	MaxBodySize      int64
+	UserAgent        string
+	Proxy            string
+	MaxRetries       int
+	RetryInterval    Duration
+	MaxRetryInterval Duration
+}
+
+func (config *FetcherConfig) setDefaults() {
+	if config.ConnectTimeout.Duration == 0 {
+		config.ConnectTimeout.Duration = time.Second * 10
+	}
+	if config.ReadTimeout.Duration == 0 {
+		config.ReadTimeout.Duration = time.Second * 30
+	}
+	if config.RequestTimeout.Duration == 0 {
+		config.RequestTimeout.Duration = time.Minute
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = 10 << 20
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = DefaultUserAgent
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 2
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.RetryInterval.Duration == 0 {
+		config.RetryInterval.Duration = time.Second
+	}
+	if config.MaxRetryInterval.Duration == 0 {
+		config.MaxRetryInterval.Duration = time.Minute
+	}
+}
+
 type Config struct {
 	PostgresConfig PostgresConfig
+	UpdaterConfig  UpdaterConfig
+	FetcherConfig  FetcherConfig
 	Host           string
 	Port           uint32
 	TemplatesPath  string
@@ -25,5 +144,7 @@ func ParseConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, errors.New("unmarshalling error: " + err.Error())
 	}
+	config.UpdaterConfig.setDefaults()
+	config.FetcherConfig.setDefaults()
 	return &config, nil
 }
@@ -2,16 +2,20 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
-	"html"
 	"log"
+	"net/url"
+	"strings"
 	"time"
 )
 
 const PostsBlockSize = 5
+const PostsInsertBatchSize = 500
+const FetchHistorySize = 100
 
 type PostgresConfig struct {
 	DBName   string
@@ -26,77 +30,603 @@ type Post struct {
 	Link        string
 	Title       string
 	Description string
-	Channel     Channel
-	ChannelID   uint
+	GUID        string
+	Author      string
+	Image       string
+	PublishedAt *time.Time
+	Identity    string  `gorm:"index:idx_post_channel_identity"`
+	Channel     Channel `json:"-"`
+	ChannelID   uint    `gorm:"index:idx_post_channel_identity"`
 }
 
+// Rule is a set of patterns to parse posts with. Named rules are templates,
+// which are offered for new channels and may be shared by many of them.
 type Rule struct {
 	gorm.Model
-	TitlePattern       string
-	ItemPattern        string
-	LinkPattern        string
-	DescriptionPattern string
+	Name                string `gorm:"index"`
+	Kind                string
+	TitlePattern        string
+	ItemPattern         string
+	LinkPattern         string
+	DescriptionPattern  string
+	DatePattern         string
+	DateLayout          string
+	AuthorPattern       string
+	GUIDPattern         string
+	ImagePattern        string
+	StripTrackingParams bool
+	OptionalFields      string
+	MaxBadItemsShare    float64
+}
+
+const (
+	ChannelHealthy  = "healthy"
+	ChannelDegraded = "degraded"
+	ChannelBroken   = "broken"
+)
+
+type ChannelHealth struct {
+	Health                       string
+	ConsecutiveFailures          int
+	ConsecutiveTemporaryFailures int
+	ConsecutiveSuccesses         int
+	LastError                    string
+}
+
+// RequestConfig holds per-channel request settings, which may contain secrets,
+// so it is loaded only for fetching and never rendered or marshalled with the channel.
+type RequestConfig struct {
+	gorm.Model
+	ChannelID uint `gorm:"unique_index"`
+	Headers   string
+	Cookies   string
+	Username  string
+	Password  string
 }
 
 type Channel struct {
 	gorm.Model
-	Name     string
-	Source   string
-	Rule     Rule
-	RuleID   uint
-	IsBroken bool
+	Name             string
+	Source           string
+	Rule             Rule
+	RuleID           uint
+	RequestConfig    RequestConfig `json:"-"`
+	IsBroken         bool
+	RefreshInterval  time.Duration
+	AdaptiveInterval time.Duration
+	NextUpdateAt     *time.Time `gorm:"index"`
+	Revision         uint
+	ChannelHealth
+	CacheValidators
+}
+
+// RuleVersion is a snapshot of rule patterns made whenever the rule changes.
+// RestoredFrom is the ID of the version the rule was rolled back to, if any.
+type RuleVersion struct {
+	gorm.Model
+	RuleID       uint `gorm:"index"`
+	Author       string
+	RestoredFrom uint
+	Snapshot     string
+}
+
+type FetchAttempt struct {
+	gorm.Model
+	ChannelID   uint `gorm:"index"`
+	StartedAt   time.Time
+	Duration    time.Duration
+	StatusCode  int
+	BytesCount  int
+	ParsedCount int
+	NewCount    int
+	Error       string
+	Warnings    string
 }
 
 type DBApi struct {
 	db *gorm.DB
 }
 
+// NotFoundError is returned when there is no record with the requested ID.
+type NotFoundError struct {
+	Message string
+}
+
+func (err *NotFoundError) Error() string {
+	return err.Message
+}
+
+// ValidationError is returned when a channel or its rule is rejected before saving.
+type ValidationError struct {
+	Message string
+}
+
+func (err *ValidationError) Error() string {
+	return err.Message
+}
+
+// isBlankRule tells whether no rule patterns were given, e.g. when only RuleID is sent.
+func isBlankRule(rule *Rule) bool {
+	return *rule == Rule{Model: rule.Model, Name: rule.Name}
+}
+
+func validateChannel(channel *Channel) error {
+	if strings.TrimSpace(channel.Name) == "" {
+		return &ValidationError{Message: "db error, empty channel name"}
+	}
+	source, err := url.Parse(strings.TrimSpace(channel.Source))
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		return &ValidationError{Message: "db error, channel source should be an http or https url, got '" + channel.Source + "'"}
+	}
+	err = channel.RequestConfig.Validate()
+	if err != nil {
+		return &ValidationError{Message: "db error, bad request config: " + err.Error()}
+	}
+	return nil
+}
+
 func (api *DBApi) CreatePost(title, link, description string, channelId uint) {
 	api.db.Create(&Post{Link: link, Title: title, Description: description, ChannelID: channelId})
 }
 
-func (api *DBApi) CreateRule(itemPattern, linkPattern, titlePattern, descriptionPattern string) (*Rule, error) {
-	rule := Rule{ItemPattern: itemPattern,
-		LinkPattern:        linkPattern,
-		TitlePattern:       titlePattern,
-		DescriptionPattern: descriptionPattern,
+func (api *DBApi) CreateRule(rule Rule) (*Rule, error) {
+	rule.Model = gorm.Model{}
+	compiledRule, err := CompileRule(&rule)
+	if err != nil {
+		return nil, &ValidationError{Message: "db error: " + err.Error()}
 	}
-	_, err := CompileRule(&rule)
+	rule.Kind = compiledRule.Kind
+	err = api.validateRuleName(&rule)
 	if err != nil {
-		return nil, errors.New("db error: " + err.Error())
+		return nil, err
 	}
 	return api.db.Create(&rule).Value.(*Rule), nil
 }
 
-func (api *DBApi) CreateChannel(name, source, itemPattern, linkPattern, titlePattern, descriptionPattern string) (*Channel, error) {
-	rule, err := api.CreateRule(itemPattern, linkPattern, titlePattern, descriptionPattern)
+func (api *DBApi) validateRuleName(rule *Rule) error {
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" {
+		return nil
+	}
+	var count int
+	err := api.db.Model(&Rule{}).Where("name = ? AND id <> ?", rule.Name, rule.ID).Count(&count).Error
+	if err != nil {
+		return errors.New("db error: " + err.Error())
+	}
+	if count > 0 {
+		return &ValidationError{Message: "db error, rule template '" + rule.Name + "' already exists"}
+	}
+	return nil
+}
+
+func (api *DBApi) GetRule(ruleId uint) (*Rule, error) {
+	var rules []Rule
+	api.db.Where("ID = ?", ruleId).Find(&rules)
+	if len(rules) != 1 {
+		return nil, &NotFoundError{Message: fmt.Sprintf("db error, empty or multiple rules by ID=%v", ruleId)}
+	}
+	return &rules[0], nil
+}
+
+// GetRuleTemplate returns the rule only if it is a template.
+func (api *DBApi) GetRuleTemplate(ruleId uint) (*Rule, error) {
+	rule, err := api.GetRule(ruleId)
+	if err != nil {
+		return nil, err
+	}
+	if rule.Name == "" {
+		return nil, &NotFoundError{Message: fmt.Sprintf("db error, rule ID=%v is not a template", ruleId)}
+	}
+	return rule, nil
+}
+
+// RuleTemplate is a template with the number of channels using it.
+type RuleTemplate struct {
+	Rule
+	ChannelsCount int
+}
+
+func (api *DBApi) ListRuleTemplates() []RuleTemplate {
+	var rules []Rule
+	api.db.Where("name <> ?", "").Order("name").Find(&rules)
+	var counts []struct {
+		RuleID        uint
+		ChannelsCount int
+	}
+	api.db.Model(&Channel{}).Select("rule_id, count(*) AS channels_count").Group("rule_id").Scan(&counts)
+	channelsCounts := make(map[uint]int)
+	for _, count := range counts {
+		channelsCounts[count.RuleID] = count.ChannelsCount
+	}
+	templates := []RuleTemplate{}
+	for _, rule := range rules {
+		templates = append(templates, RuleTemplate{Rule: rule, ChannelsCount: channelsCounts[rule.ID]})
+	}
+	return templates
+}
+
+// inTransaction runs the function with a DBApi working in one transaction,
+// which is committed if the function succeeds and rolled back otherwise.
+func (api *DBApi) inTransaction(function func(txApi *DBApi) error) error {
+	tx := api.db.Begin()
+	if tx.Error != nil {
+		return errors.New("beginning transaction error: " + tx.Error.Error())
+	}
+	err := function(&DBApi{db: tx})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return errors.New("committing transaction error: " + err.Error())
+	}
+	return nil
+}
+
+// UpdateRule replaces the patterns of the rule, which is recorded in the rule history,
+// and updates every channel using the rule right away.
+func (api *DBApi) UpdateRule(rule Rule, author string) (*Rule, error) {
+	var updatedRule *Rule
+	err := api.inTransaction(func(txApi *DBApi) error {
+		var err error
+		updatedRule, err = txApi.updateRule(rule, author)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updatedRule, nil
+}
+
+func (api *DBApi) updateRule(rule Rule, author string) (*Rule, error) {
+	existingRule, err := api.GetRule(rule.ID)
+	if err != nil {
+		return nil, err
+	}
+	compiledRule, err := CompileRule(&rule)
+	if err != nil {
+		return nil, &ValidationError{Message: "db error: " + err.Error()}
+	}
+	rule.Kind = compiledRule.Kind
+	rule.Model = existingRule.Model
+	err = api.validateRuleName(&rule)
+	if err != nil {
+		return nil, err
+	}
+	err = api.saveRule(existingRule, &rule, author, 0)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("db error, updating rule ID=%v: %s", rule.ID, err.Error()))
+	}
+	err = api.refreshRuleChannels(rule.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func (api *DBApi) CreateChannel(channel Channel) (*Channel, error) {
+	err := validateChannel(&channel)
+	if err != nil {
+		return nil, err
+	}
+	var rule *Rule
+	if channel.RuleID != 0 {
+		rule, err = api.GetRuleTemplate(channel.RuleID)
+		if err != nil {
+			return nil, &ValidationError{Message: err.Error()}
+		}
+	} else {
+		rule, err = api.CreateRule(channel.Rule)
+		if err != nil {
+			return nil, err
+		}
+	}
+	channel.Model = gorm.Model{}
+	channel.RequestConfig.Model = gorm.Model{}
+	channel.RequestConfig.ChannelID = 0
+	channel.Rule = Rule{}
+	channel.RuleID = rule.ID
+	channel.IsBroken = false
+	channel.ChannelHealth = ChannelHealth{Health: ChannelHealthy}
+	channel.CacheValidators = CacheValidators{}
+	channel.AdaptiveInterval = 0
+	channel.NextUpdateAt = nil
+	createdChannel := api.db.Create(&channel).Value.(*Channel)
+	createdChannel.Rule = *rule
+	createdChannel.RequestConfig = RequestConfig{}
+	return createdChannel, nil
+}
+
+func (api *DBApi) GetChannelRequestConfig(channelId uint) (*RequestConfig, error) {
+	var configs []RequestConfig
+	err := api.db.Where("channel_id = ?", channelId).Find(&configs).Error
 	if err != nil {
 		return nil, errors.New("db error: " + err.Error())
 	}
-	channel := Channel{RuleID: rule.ID, Name: name, Source: source, IsBroken: false}
-	return api.db.Create(&channel).Value.(*Channel), nil
+	if len(configs) == 0 {
+		return &RequestConfig{ChannelID: channelId}, nil
+	}
+	return &configs[0], nil
 }
 
-func (api *DBApi) MarkChannelAsBroken(channelId uint) error {
-	var channels []Channel
-	api.db.Where("ID = ?", channelId).Find(&channels)
-	if len(channels) != 1 {
-		return errors.New(fmt.Sprintf("db error, empty or multiple channels by ID=%v", channelId))
+// UpdateChannelRequestConfig replaces the request settings of the channel.
+func (api *DBApi) UpdateChannelRequestConfig(channelId uint, requestConfig RequestConfig) error {
+	err := requestConfig.Validate()
+	if err != nil {
+		return &ValidationError{Message: "db error, bad request config: " + err.Error()}
+	}
+	existingConfig, err := api.GetChannelRequestConfig(channelId)
+	if err != nil {
+		return err
+	}
+	requestConfig.Model = existingConfig.Model
+	requestConfig.ChannelID = channelId
+	err = api.db.Save(&requestConfig).Error
+	if err != nil {
+		return errors.New(fmt.Sprintf("db error, updating channel ID=%v request config: %s", channelId, err.Error()))
 	}
-	channel := channels[0]
-	api.db.Model(channel).Where("ID = ?", channel.ID).Update("IsBroken", true)
 	return nil
 }
 
+// UpdateChannel changes the name, source, refresh interval and rule of the channel
+// keeping its posts. Since the new source or rule may give other content,
+// the cache validators are dropped and the channel is due right away.
+// A changed rule is recorded in the rule history on behalf of the author.
+// The request settings are replaced only if requestConfig is not nil.
+// Everything is saved in one transaction.
+//
+// The channel switches to another template if its RuleID is set to one. Otherwise
+// the rule of the channel is updated in place, which affects every channel sharing it,
+// unless RuleID is 0 and the channel used a template: then it gets its own rule.
+func (api *DBApi) UpdateChannel(channel Channel, requestConfig *RequestConfig, author string) (*Channel, error) {
+	err := api.inTransaction(func(txApi *DBApi) error {
+		return txApi.updateChannel(channel, requestConfig, author)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return api.GetChannelById(channel.ID)
+}
+
+func (api *DBApi) updateChannel(channel Channel, requestConfig *RequestConfig, author string) error {
+	existingChannel, err := api.GetChannelById(channel.ID)
+	if err != nil {
+		return err
+	}
+	channel.RequestConfig = RequestConfig{}
+	err = validateChannel(&channel)
+	if err != nil {
+		return err
+	}
+	ruleId := existingChannel.RuleID
+	switch {
+	case channel.RuleID != 0 && channel.RuleID != existingChannel.RuleID:
+		template, err := api.GetRuleTemplate(channel.RuleID)
+		if err != nil {
+			return &ValidationError{Message: err.Error()}
+		}
+		ruleId = template.ID
+	case channel.RuleID != 0 && isBlankRule(&channel.Rule):
+	case channel.RuleID == 0 && existingChannel.Rule.Name != "":
+		if strings.TrimSpace(channel.Rule.Name) == existingChannel.Rule.Name {
+			channel.Rule.Name = ""
+		}
+		rule, err := api.CreateRule(channel.Rule)
+		if err != nil {
+			return err
+		}
+		ruleId = rule.ID
+	default:
+		rule := channel.Rule
+		rule.ID = existingChannel.RuleID
+		_, err = api.updateRule(rule, author)
+		if err != nil {
+			return err
+		}
+	}
+	err = api.db.Model(&Channel{}).Where("ID = ?", channel.ID).UpdateColumns(map[string]interface{}{
+		"name":              channel.Name,
+		"source":            channel.Source,
+		"rule_id":           ruleId,
+		"refresh_interval":  channel.RefreshInterval,
+		"adaptive_interval": 0,
+		"next_update_at":    nil,
+		"etag":              "",
+		"last_modified":     "",
+		"revision":          gorm.Expr("revision + 1"),
+	}).Error
+	if err != nil {
+		return errors.New(fmt.Sprintf("db error, updating channel ID=%v: %s", channel.ID, err.Error()))
+	}
+	if requestConfig != nil {
+		return api.UpdateChannelRequestConfig(channel.ID, *requestConfig)
+	}
+	return nil
+}
+
+func snapshotRule(rule Rule) (string, error) {
+	rule.Model = gorm.Model{}
+	rawRule, err := json.Marshal(rule)
+	if err != nil {
+		return "", err
+	}
+	return string(rawRule), nil
+}
+
+// Rule returns the rule patterns as they were in the version.
+func (version *RuleVersion) Rule() (*Rule, error) {
+	var rule Rule
+	err := json.Unmarshal([]byte(version.Snapshot), &rule)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("decoding rule version ID=%v error: %s", version.ID, err.Error()))
+	}
+	rule.Model = gorm.Model{}
+	return &rule, nil
+}
+
+// addRuleVersion records the rule patterns unless they are the same as in the last version.
+func (api *DBApi) addRuleVersion(rule *Rule, author string, restoredFrom uint, createdAt time.Time) error {
+	snapshot, err := snapshotRule(*rule)
+	if err != nil {
+		return err
+	}
+	var lastVersions []RuleVersion
+	err = api.db.Where("rule_id = ?", rule.ID).Order("id DESC").Limit(1).Find(&lastVersions).Error
+	if err != nil {
+		return err
+	}
+	if len(lastVersions) == 1 && lastVersions[0].Snapshot == snapshot {
+		return nil
+	}
+	version := RuleVersion{RuleID: rule.ID, Author: author, RestoredFrom: restoredFrom, Snapshot: snapshot}
+	version.CreatedAt = createdAt
+	return api.db.Create(&version).Error
+}
+
+// saveRule replaces the previous rule with the new one keeping both in the rule history.
+// Rules which were created before the history had been kept get their first version here.
+func (api *DBApi) saveRule(previousRule, rule *Rule, author string, restoredFrom uint) error {
+	var versionsCount int
+	err := api.db.Model(&RuleVersion{}).Where("rule_id = ?", previousRule.ID).Count(&versionsCount).Error
+	if err != nil {
+		return err
+	}
+	if versionsCount == 0 {
+		err = api.addRuleVersion(previousRule, "", 0, previousRule.UpdatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	err = api.db.Save(rule).Error
+	if err != nil {
+		return err
+	}
+	return api.addRuleVersion(rule, author, restoredFrom, time.Now())
+}
+
+// GetRuleHistory returns the versions of the rule, the latest first.
+func (api *DBApi) GetRuleHistory(ruleId uint) []RuleVersion {
+	var versions []RuleVersion
+	api.db.Where("rule_id = ?", ruleId).Order("id DESC").Find(&versions)
+	return versions
+}
+
+// RollbackRule restores the rule patterns from one of its versions,
+// which makes a new version, and updates every channel using the rule right away.
+func (api *DBApi) RollbackRule(ruleId, versionId uint, author string) (*Rule, error) {
+	var rule *Rule
+	err := api.inTransaction(func(txApi *DBApi) error {
+		var err error
+		rule, err = txApi.rollbackRule(ruleId, versionId, author)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func (api *DBApi) rollbackRule(ruleId, versionId uint, author string) (*Rule, error) {
+	var rules []Rule
+	api.db.Where("ID = ?", ruleId).Find(&rules)
+	if len(rules) != 1 {
+		return nil, &NotFoundError{Message: fmt.Sprintf("db error, empty or multiple rules by ID=%v", ruleId)}
+	}
+	var versions []RuleVersion
+	api.db.Where("ID = ? AND rule_id = ?", versionId, ruleId).Find(&versions)
+	if len(versions) != 1 {
+		return nil, &NotFoundError{Message: fmt.Sprintf("db error, no version ID=%v of rule ID=%v", versionId, ruleId)}
+	}
+	rule, err := versions[0].Rule()
+	if err != nil {
+		return nil, errors.New("db error: " + err.Error())
+	}
+	_, err = CompileRule(rule)
+	if err != nil {
+		return nil, &ValidationError{Message: "db error: " + err.Error()}
+	}
+	rule.Model = rules[0].Model
+	// The name is not rolled back: an old name may be taken by another template by now,
+	// and an old empty name would hide the rule which channels still share from the templates.
+	rule.Name = rules[0].Name
+	err = api.saveRule(&rules[0], rule, author, versionId)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("db error, rolling back rule ID=%v: %s", ruleId, err.Error()))
+	}
+	err = api.refreshRuleChannels(ruleId)
+	if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// refreshRuleChannels drops the cache validators of the channels using the rule
+// and makes them due right away, since the changed rule may give other posts.
+func (api *DBApi) refreshRuleChannels(ruleId uint) error {
+	err := api.db.Model(&Channel{}).Where("rule_id = ?", ruleId).UpdateColumns(map[string]interface{}{
+		"next_update_at": nil,
+		"etag":           "",
+		"last_modified":  "",
+		"revision":       gorm.Expr("revision + 1"),
+	}).Error
+	if err != nil {
+		return errors.New(fmt.Sprintf("db error, refreshing channels of rule ID=%v: %s", ruleId, err.Error()))
+	}
+	return nil
+}
+
+// ScheduleChannelUpdate sets the time of the next update of the channel unless the channel
+// or its rule has been edited since the given revision: then the channel stays due right away.
+func (api *DBApi) ScheduleChannelUpdate(channelId, revision uint, updateAt time.Time, adaptiveInterval time.Duration) error {
+	err := api.db.Model(&Channel{}).Where("ID = ? AND revision = ?", channelId, revision).UpdateColumns(map[string]interface{}{
+		"next_update_at":    updateAt,
+		"adaptive_interval": adaptiveInterval,
+	}).Error
+	if err != nil {
+		return errors.New(fmt.Sprintf("db error, scheduling channel ID=%v update: %s", channelId, err.Error()))
+	}
+	return nil
+}
+
+// UpdateChannelHealth records the result of an update unless the channel
+// or its rule has been edited since the given revision.
+func (api *DBApi) UpdateChannelHealth(channelId, revision uint, health ChannelHealth) error {
+	err := api.db.Model(&Channel{}).Where("ID = ? AND revision = ?", channelId, revision).UpdateColumns(map[string]interface{}{
+		"is_broken":                      health.Health == ChannelBroken,
+		"health":                         health.Health,
+		"consecutive_failures":           health.ConsecutiveFailures,
+		"consecutive_temporary_failures": health.ConsecutiveTemporaryFailures,
+		"consecutive_successes":          health.ConsecutiveSuccesses,
+		"last_error":                     health.LastError,
+	}).Error
+	if err != nil {
+		return errors.New(fmt.Sprintf("db error, updating channel ID=%v health: %s", channelId, err.Error()))
+	}
+	return nil
+}
+
+// DeleteChannel deletes the channel together with its posts, fetch history and request settings.
 func (api *DBApi) DeleteChannel(channelId uint) error {
 	var channels []Channel
 	api.db.Where("ID = ?", channelId).Find(&channels)
 	if len(channels) != 1 {
-		return errors.New(fmt.Sprintf("db error, empty or multiple channels by ID=%v", channelId))
+		return &NotFoundError{Message: fmt.Sprintf("db error, empty or multiple channels by ID=%v", channelId)}
 	}
 	channel := channels[0]
-	api.db.Unscoped().Delete(&channel)
-	return nil
+	return api.inTransaction(func(txApi *DBApi) error {
+		for _, value := range []interface{}{Post{}, FetchAttempt{}, RequestConfig{}} {
+			err := txApi.db.Unscoped().Where("channel_id = ?", channel.ID).Delete(value).Error
+			if err != nil {
+				return errors.New(fmt.Sprintf("db error, deleting channel ID=%v: %s", channel.ID, err.Error()))
+			}
+		}
+		err := txApi.db.Unscoped().Delete(&channel).Error
+		if err != nil {
+			return errors.New(fmt.Sprintf("db error, deleting channel ID=%v: %s", channel.ID, err.Error()))
+		}
+		return nil
+	})
 }
 
 func (api *DBApi) ListChannels() []Channel {
@@ -105,49 +635,244 @@ func (api *DBApi) ListChannels() []Channel {
 	return channels
 }
 
+// ListDueChannels returns the channels which should be updated at the moment, without their rules.
+func (api *DBApi) ListDueChannels(now time.Time) []Channel {
+	var channels []Channel
+	api.db.Where("next_update_at IS NULL OR next_update_at <= ?", now).Find(&channels)
+	return channels
+}
+
+// NextChannelUpdateAt returns the time when the first of the channels which are not due yet
+// should be updated or nil if there are no such channels.
+func (api *DBApi) NextChannelUpdateAt(now time.Time) *time.Time {
+	var result struct {
+		NextUpdateAt *time.Time
+	}
+	api.db.Model(&Channel{}).Select("MIN(next_update_at) AS next_update_at").Where("next_update_at > ?", now).Scan(&result)
+	return result.NextUpdateAt
+}
+
 func (api *DBApi) RemoveChannelContent(channel *Channel) {
 	api.db.Unscoped().Where("channel_id = ?", channel.ID).Delete(Post{})
 }
 
-func (api *DBApi) FetchChannelContent(channel *Channel) error {
+// FetchStats tells how many posts were parsed and how many of them were new.
+// All posts are new on the first fetch, when the channel had no posts.
+type FetchStats struct {
+	ParsedCount int
+	NewCount    int
+	HadPosts    bool
+}
+
+func (api *DBApi) hasPosts(channelId uint) bool {
+	var posts []Post
+	api.db.Select("id").Where("channel_id = ?", channelId).Limit(1).Find(&posts)
+	return len(posts) > 0
+}
+
+// FetchChannelContent fetches new posts of the channel
+// and records the attempt in the channel fetch history.
+func (api *DBApi) FetchChannelContent(channel *Channel) (*FetchStats, error) {
+	attempt := FetchAttempt{ChannelID: channel.ID, StartedAt: time.Now()}
+	hadPosts := api.hasPosts(channel.ID)
+	err := api.fetchChannelContent(channel, &attempt)
+	attempt.Duration = time.Since(attempt.StartedAt)
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	historyErr := api.AddFetchAttempt(&attempt)
+	if historyErr != nil {
+		log.Println("recording fetch attempt error: " + historyErr.Error())
+	}
+	if err != nil {
+		return nil, wrapError(fmt.Sprintf("db error, channel ID=%v, error=", channel.ID), err)
+	}
+	return &FetchStats{ParsedCount: attempt.ParsedCount, NewCount: attempt.NewCount, HadPosts: hadPosts}, nil
+}
+
+func (api *DBApi) fetchChannelContent(channel *Channel, attempt *FetchAttempt) error {
 	rule, err := CompileRule(&channel.Rule)
 	if err != nil {
-		return errors.New(fmt.Sprintf("db error, channel ID=%v, error=%s", channel.ID, err.Error()))
+		return err
+	}
+	requestConfig, err := api.GetChannelRequestConfig(channel.ID)
+	if err != nil {
+		return err
+	}
+	posts, info, err := GetContentWithInfo(channel.Source, rule, channel.CacheValidators, requestConfig)
+	if info != nil {
+		attempt.StatusCode = info.StatusCode
+		attempt.BytesCount = info.BytesCount
+		attempt.Warnings = strings.Join(info.Warnings, "\n")
+		for _, warning := range info.Warnings {
+			log.Printf("channel %v parsing warning: %v", channel.ID, warning)
+		}
 	}
-	posts, err := GetContent(channel.Source, rule)
 	if err != nil {
-		return errors.New(fmt.Sprintf("db error, channel ID=%v, error=%s", channel.ID, err.Error()))
+		return err
+	}
+	if info.NotModified {
+		return nil
 	}
+	attempt.ParsedCount = len(posts)
+	attempt.NewCount, err = api.UpsertChannelPosts(channel.ID, posts)
 	if err != nil {
-		return errors.New(fmt.Sprintf("db error, channel ID=%v, error=%s", channel.ID, err.Error()))
+		return err
 	}
-	for _, post := range posts {
-		dbApi.CreatePost(post.Title, post.Link, html.UnescapeString(post.Description), channel.ID)
+	return api.UpdateChannelValidators(channel.ID, channel.Revision, info.Validators)
+}
+
+// UpdateChannelValidators keeps the cache validators of the fetched content unless the channel
+// or its rule has been edited since the given revision, so that the new rule gets full content.
+func (api *DBApi) UpdateChannelValidators(channelId, revision uint, validators CacheValidators) error {
+	err := api.db.Model(&Channel{}).Where("ID = ? AND revision = ?", channelId, revision).UpdateColumns(map[string]interface{}{
+		"etag":          validators.ETag,
+		"last_modified": validators.LastModified,
+	}).Error
+	if err != nil {
+		return errors.New(fmt.Sprintf("db error, updating channel ID=%v validators: %s", channelId, err.Error()))
+	}
+	return nil
+}
+
+// AddFetchAttempt records the attempt and keeps only
+// the last FetchHistorySize attempts of its channel.
+func (api *DBApi) AddFetchAttempt(attempt *FetchAttempt) error {
+	err := api.db.Create(attempt).Error
+	if err != nil {
+		return errors.New("db error: " + err.Error())
+	}
+	err = api.db.Unscoped().Where("channel_id = ? AND id NOT IN ?", attempt.ChannelID,
+		api.db.Table("fetch_attempts").Select("id").Where("channel_id = ?", attempt.ChannelID).
+			Order("id DESC").Limit(FetchHistorySize).SubQuery()).Delete(FetchAttempt{}).Error
+	if err != nil {
+		return errors.New("db error, removing old fetch attempts: " + err.Error())
 	}
 	return nil
 }
 
+func (api *DBApi) GetFetchHistory(channelId uint) []FetchAttempt {
+	var attempts []FetchAttempt
+	api.db.Where("channel_id = ?", channelId).Order("started_at DESC").Order("id DESC").Find(&attempts)
+	return attempts
+}
+
+// UpsertChannelPosts stores posts which are not yet known in the channel
+// in a single transaction and returns the number of created posts.
+func (api *DBApi) UpsertChannelPosts(channelId uint, posts []Post) (int, error) {
+	if len(posts) == 0 {
+		return 0, nil
+	}
+	tx := api.db.Begin()
+	if tx.Error != nil {
+		return 0, errors.New("beginning transaction error: " + tx.Error.Error())
+	}
+	createdCount, err := upsertChannelPosts(tx, channelId, posts)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return 0, errors.New("committing transaction error: " + err.Error())
+	}
+	return createdCount, nil
+}
+
+func upsertChannelPosts(tx *gorm.DB, channelId uint, posts []Post) (int, error) {
+	var channel Channel
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("ID = ?", channelId).First(&channel).Error
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("locking channel ID=%v error: %s", channelId, err.Error()))
+	}
+
+	var identities []string
+	for i := range posts {
+		posts[i].Identity = PostIdentity(&posts[i])
+		identities = append(identities, posts[i].Identity)
+	}
+
+	var existingPosts []Post
+	err = tx.Select("identity").Where("channel_id = ? AND identity IN (?)", channelId, identities).Find(&existingPosts).Error
+	if err != nil {
+		return 0, errors.New("selecting existing posts error: " + err.Error())
+	}
+	knownIdentities := make(map[string]bool)
+	for _, post := range existingPosts {
+		knownIdentities[post.Identity] = true
+	}
+
+	fetchedAt := time.Now()
+	var newPosts []Post
+	for _, post := range posts {
+		if knownIdentities[post.Identity] {
+			continue
+		}
+		knownIdentities[post.Identity] = true
+		post.ChannelID = channelId
+		post.CreatedAt = fetchedAt
+		post.UpdatedAt = fetchedAt
+		newPosts = append(newPosts, post)
+	}
+
+	for start := 0; start < len(newPosts); start += PostsInsertBatchSize {
+		end := start + PostsInsertBatchSize
+		if end > len(newPosts) {
+			end = len(newPosts)
+		}
+		err = insertPosts(tx, newPosts[start:end])
+		if err != nil {
+			return 0, errors.New("creating posts error: " + err.Error())
+		}
+	}
+	return len(newPosts), nil
+}
+
+// insertPosts creates all posts with one multi-row INSERT, which gorm can not do by itself.
+func insertPosts(tx *gorm.DB, posts []Post) error {
+	var placeholders []string
+	var values []interface{}
+	for _, post := range posts {
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		values = append(values,
+			post.CreatedAt,
+			post.UpdatedAt,
+			post.Link,
+			post.Title,
+			post.Description,
+			post.GUID,
+			post.Author,
+			post.Image,
+			post.PublishedAt,
+			post.Identity,
+			post.ChannelID,
+		)
+	}
+	query := "INSERT INTO posts (created_at, updated_at, link, title, description, guid, author, image, published_at, identity, channel_id) VALUES " +
+		strings.Join(placeholders, ", ")
+	return tx.Exec(query, values...).Error
+}
+
 func (api *DBApi) GetChannelById(channelId uint) (*Channel, error) {
 	var channels []Channel
 	api.db.Preload("Rule").Where("ID = ?", channelId).Find(&channels)
 	if len(channels) != 1 {
 		log.Println(channels)
-		return nil, errors.New(fmt.Sprintf("db error, empty or multiple channels by ID=%v", channelId))
+		return nil, &NotFoundError{Message: fmt.Sprintf("db error, empty or multiple channels by ID=%v", channelId)}
 	}
 	return &channels[0], nil
 }
 
-func (api *DBApi) UpdateChannelContent(channelId uint) error {
+func (api *DBApi) UpdateChannelContent(channelId uint) (*FetchStats, error) {
 	channel, err := api.GetChannelById(channelId)
 	if err != nil {
-		return errors.New("getting channel error: " + err.Error())
+		return nil, errors.New("getting channel error: " + err.Error())
 	}
-	api.RemoveChannelContent(channel)
-	err = api.FetchChannelContent(channel)
+	stats, err := api.FetchChannelContent(channel)
 	if err != nil {
-		return errors.New("fetching channel content error: " + err.Error())
+		return nil, wrapError("fetching channel content error: ", err)
 	}
-	return nil
+	return stats, nil
 }
 
 func (api *DBApi) GetChannelContentWithLimit(channelId, offset, limit uint, filter string) []Post {
@@ -155,10 +880,70 @@ func (api *DBApi) GetChannelContentWithLimit(channelId, offset, limit uint, filt
 	api.db.Where("ID = ?", channelId).First(&channel)
 	var posts []Post
 	fmtFilter := fmt.Sprintf("%%%v%%", filter)
-	api.db.Model(&channel).Offset(offset).Limit(limit).Where("title ILIKE ?", fmtFilter).Related(&posts, "Post")
+	api.db.Model(&channel).Order("COALESCE(published_at, created_at) DESC").Order("id").Offset(offset).Limit(limit).Where("title ILIKE ?", fmtFilter).Related(&posts, "Post")
 	return posts
 }
 
+// PostsCursor points to the last post of a page by the post sort key.
+type PostsCursor struct {
+	Date time.Time
+	ID   uint
+}
+
+// PostsQuery selects a page of posts sorted by publication date,
+// or by fetch date for posts without one, and then by ID.
+type PostsQuery struct {
+	ChannelID uint
+	Title     string
+	Since     *time.Time
+	Until     *time.Time
+	Ascending bool
+	After     *PostsCursor
+	Limit     int
+}
+
+// QueryPosts returns a page of posts and the cursor of the next page,
+// which is nil if there are no more posts.
+func (api *DBApi) QueryPosts(query *PostsQuery) ([]Post, *PostsCursor, error) {
+	db := api.db.Model(&Post{})
+	if query.ChannelID != 0 {
+		db = db.Where("channel_id = ?", query.ChannelID)
+	}
+	if query.Title != "" {
+		db = db.Where("title ILIKE ?", fmt.Sprintf("%%%v%%", query.Title))
+	}
+	if query.Since != nil {
+		db = db.Where("COALESCE(published_at, created_at) >= ?", *query.Since)
+	}
+	if query.Until != nil {
+		db = db.Where("COALESCE(published_at, created_at) < ?", *query.Until)
+	}
+	direction, comparison := "DESC", "<"
+	if query.Ascending {
+		direction, comparison = "ASC", ">"
+	}
+	if query.After != nil {
+		db = db.Where(fmt.Sprintf("(COALESCE(published_at, created_at), id) %v (?, ?)", comparison), query.After.Date, query.After.ID)
+	}
+
+	var posts []Post
+	err := db.Order("COALESCE(published_at, created_at) " + direction).Order("id " + direction).
+		Limit(query.Limit + 1).Find(&posts).Error
+	if err != nil {
+		return nil, nil, errors.New("db error, querying posts: " + err.Error())
+	}
+	if len(posts) <= query.Limit {
+		return posts, nil, nil
+	}
+	posts = posts[:query.Limit]
+	last := posts[len(posts)-1]
+	cursor := PostsCursor{Date: last.CreatedAt, ID: last.ID}
+	if last.PublishedAt != nil {
+		cursor.Date = *last.PublishedAt
+	}
+	return posts, &cursor, nil
+}
+
 func (api *DBApi) GetChannelContent(channelId uint) []Post {
 	var channel Channel
 	api.db.Where("ID = ?", channelId).First(&channel)
@@ -213,31 +998,64 @@ func AddExampleChannels(api *DBApi) error {
 	if len(api.ListChannels()) != 0 {
 		return nil
 	}
-	_, err := api.CreateChannel(
-		"Habr",
-		"https://habr.com",
-		"(?s)<article\\sclass=\"post\\spost_preview\">(.*?)</article>",
-		"<a\\shref=\"(.*?)\"\\sclass=\"post__title_link\">.*?</a>",
-		"<a\\shref=\".*?\"\\sclass=\"post__title_link\">(.*?)</a>",
-		"(?s)<div\\sclass=\"post__text\\spost__text-html\\sjs-mediator-article\">(.*?)</div>\\s\\s\\s\\s\\s\\s\\s\\s\\s\\s<a class=\"btn\\sbtn_x-large\\sbtn_outline_blue\\spost__habracut-btn\"",
-	)
+	_, err := api.CreateChannel(Channel{Name: "Habr", Source: "https://habr.com", Rule: Rule{
+		Kind:               RegexpRuleKind,
+		ItemPattern:        "(?s)<article\\sclass=\"post\\spost_preview\">(.*?)</article>",
+		LinkPattern:        "<a\\shref=\"(.*?)\"\\sclass=\"post__title_link\">.*?</a>",
+		TitlePattern:       "<a\\shref=\".*?\"\\sclass=\"post__title_link\">(.*?)</a>",
+		DescriptionPattern: "(?s)<div\\sclass=\"post__text\\spost__text-html\\sjs-mediator-article\">(.*?)</div>\\s\\s\\s\\s\\s\\s\\s\\s\\s\\s<a class=\"btn\\sbtn_x-large\\sbtn_outline_blue\\spost__habracut-btn\"",
+		AuthorPattern:      "<span\\sclass=\"user-info__nickname user-info__nickname_small\">(.*?)</span>",
+	}})
 	if err != nil {
 		return errors.New("Can not create Habr channel: " + err.Error())
 	}
-	_, err = api.CreateChannel(
-		"Ubuntu Planet",
-		"http://planet.ubuntu.com/rss20.xml",
-		"(?s)<item>(.*?)</item>",
-		"(?s)<link>(.*?)</link>",
-		"<title>(.*?)</title>",
-		"(?s)<description>(.*?)</description>",
-	)
+	_, err = api.CreateChannel(Channel{Name: "Ubuntu Planet", Source: "http://planet.ubuntu.com/rss20.xml", Rule: Rule{Name: "RSS 2.0 / Atom feed", Kind: FeedRuleKind}})
 	if err != nil {
 		return errors.New("Can not create Ubuntu Planet channel: " + err.Error())
 	}
 	return nil
 }
 
+func (api *DBApi) fillPostIdentities() {
+	var posts []Post
+	api.db.Select("id, guid, link").Where("identity = ?", "").Find(&posts)
+	for _, post := range posts {
+		api.db.Model(&Post{}).Where("id = ?", post.ID).UpdateColumn("identity", PostIdentity(&post))
+	}
+}
+
+// resolveStoredPostLinks makes links of posts saved before link resolving absolute,
+// so that refreshes recognize them instead of adding the same posts again.
+func (api *DBApi) resolveStoredPostLinks() {
+	relativeLinkCondition := "link <> '' AND link NOT LIKE '%://%'"
+	var channels []Channel
+	api.db.Preload("Rule").Where("id IN (SELECT channel_id FROM posts WHERE deleted_at IS NULL AND " + relativeLinkCondition + ")").Find(&channels)
+	for _, channel := range channels {
+		var posts []Post
+		api.db.Select("id, guid, link, image").Where("channel_id = ?", channel.ID).Where(relativeLinkCondition).Find(&posts)
+		resolvePostLinks(posts, DocumentBase(channel.Source, nil, false), channel.Rule.StripTrackingParams)
+		for _, post := range posts {
+			api.db.Model(&Post{}).Where("id = ?", post.ID).UpdateColumns(map[string]interface{}{
+				"link":     post.Link,
+				"image":    post.Image,
+				"identity": PostIdentity(&post),
+			})
+		}
+	}
+}
+
+// addPostsSortIndexes lets the pages of posts sorted by publication date
+// be read by an index instead of sorting all the posts.
+func (api *DBApi) addPostsSortIndexes() {
+	api.db.Exec("CREATE INDEX IF NOT EXISTS idx_post_sort_date ON posts ((COALESCE(published_at, created_at)), id)")
+	api.db.Exec("CREATE INDEX IF NOT EXISTS idx_post_channel_sort_date ON posts (channel_id, (COALESCE(published_at, created_at)), id)")
+}
+
+func (api *DBApi) fillChannelHealth() {
+	api.db.Model(&Channel{}).Where("health = ? AND is_broken", "").UpdateColumn("health", ChannelBroken)
+	api.db.Model(&Channel{}).Where("health = ?", "").UpdateColumn("health", ChannelHealthy)
+}
+
 func (api *DBApi) Init(config *PostgresConfig, addExamples bool) {
 	err := CreateDbIfNotExistsWithRetry(config, time.Second * 10)
 	if err != nil {
@@ -250,6 +1068,13 @@ func (api *DBApi) Init(config *PostgresConfig, addExamples bool) {
 	api.db.AutoMigrate(&Post{})
 	api.db.AutoMigrate(&Rule{})
 	api.db.AutoMigrate(&Channel{})
+	api.db.AutoMigrate(&FetchAttempt{})
+	api.db.AutoMigrate(&RequestConfig{})
+	api.db.AutoMigrate(&RuleVersion{})
+	api.addPostsSortIndexes()
+	api.fillPostIdentities()
+	api.resolveStoredPostLinks()
+	api.fillChannelHealth()
 	if !addExamples {
 		return
 	}
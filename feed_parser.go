@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// feedAutoClose is xml.HTMLAutoClose without "link", which is a regular element in feeds.
+var feedAutoClose = htmlAutoCloseExcept("link")
+
+type feedText struct {
+	Inner string `xml:",innerxml"`
+}
+
+// Text returns the element content with CDATA sections unwrapped and entities decoded,
+// so escaped, CDATA-wrapped and inline markup all end up as the same plain string.
+func (text feedText) Text() string {
+	var result strings.Builder
+	rest := text.Inner
+	for {
+		start := strings.Index(rest, "<![CDATA[")
+		if start == -1 {
+			result.WriteString(html.UnescapeString(rest))
+			break
+		}
+		result.WriteString(html.UnescapeString(rest[:start]))
+		rest = rest[start+len("<![CDATA["):]
+		end := strings.Index(rest, "]]>")
+		if end == -1 {
+			result.WriteString(rest)
+			break
+		}
+		result.WriteString(rest[:end])
+		rest = rest[end+len("]]>"):]
+	}
+	return strings.TrimSpace(result.String())
+}
+
+type feedMedia struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Medium string `xml:"medium,attr"`
+}
+
+func (media *feedMedia) isImage() bool {
+	return media.URL != "" && (media.Medium == "image" || strings.HasPrefix(media.Type, "image/"))
+}
+
+type rssItem struct {
+	Title       feedText    `xml:"title"`
+	Link        feedText    `xml:"link"`
+	Description feedText    `xml:"description"`
+	Content     feedText    `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	GUID        feedText    `xml:"guid"`
+	PubDate     feedText    `xml:"pubDate"`
+	Author      feedText    `xml:"author"`
+	Creator     feedText    `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Enclosures  []feedMedia `xml:"enclosure"`
+	Thumbnails  []feedMedia `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	Media       []feedMedia `xml:"http://search.yahoo.com/mrss/ content"`
+}
+
+func (item *rssItem) image() string {
+	if len(item.Thumbnails) != 0 {
+		return item.Thumbnails[0].URL
+	}
+	for _, media := range append(item.Enclosures, item.Media...) {
+		if media.isImage() {
+			return media.URL
+		}
+	}
+	return ""
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type atomEntry struct {
+	Title     feedText   `xml:"title"`
+	Links     []atomLink `xml:"link"`
+	Summary   feedText   `xml:"summary"`
+	Content   feedText   `xml:"content"`
+	ID        feedText   `xml:"id"`
+	Published feedText   `xml:"published"`
+	Updated   feedText   `xml:"updated"`
+	Author    struct {
+		Name feedText `xml:"name"`
+	} `xml:"author"`
+	Thumbnails []feedMedia `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+}
+
+type feed struct {
+	XMLName xml.Name
+	Items   []rssItem   `xml:"channel>item"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func htmlAutoCloseExcept(excluded string) []string {
+	var result []string
+	for _, name := range xml.HTMLAutoClose {
+		if name != excluded {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+func parseFeedDate(value string) *time.Time {
+	for _, layout := range dateLayouts {
+		date, err := time.Parse(layout, value)
+		if err == nil {
+			return &date
+		}
+	}
+	return nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func (entry *atomEntry) image() string {
+	for _, link := range entry.Links {
+		if link.Rel == "enclosure" && strings.HasPrefix(link.Type, "image/") {
+			return link.Href
+		}
+	}
+	if len(entry.Thumbnails) != 0 {
+		return entry.Thumbnails[0].URL
+	}
+	return ""
+}
+
+func (entry *atomEntry) link() string {
+	for _, link := range entry.Links {
+		if link.Rel == "" || link.Rel == "alternate" {
+			return link.Href
+		}
+	}
+	if len(entry.Links) != 0 {
+		return entry.Links[0].Href
+	}
+	return ""
+}
+
+func ParseFeed(content []byte) ([]Post, error) {
+	posts, _, err := parseFeedContent(content)
+	return posts, err
+}
+
+// parseFeedContent skips entries which have neither a link nor a guid,
+// since they can not be told apart, and reports them as warnings.
+func parseFeedContent(content []byte) ([]Post, *ParseReport, error) {
+	var parsedFeed feed
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = feedAutoClose
+	decoder.Entity = xml.HTMLEntity
+	err := decoder.Decode(&parsedFeed)
+	if err != nil {
+		return nil, nil, errors.New("feed decoding error: " + err.Error())
+	}
+
+	var posts []Post
+	switch parsedFeed.XMLName.Local {
+	case "rss":
+		for _, item := range parsedFeed.Items {
+			posts = append(posts, Post{
+				Title:       item.Title.Text(),
+				Link:        item.Link.Text(),
+				Description: firstNonEmpty(item.Description.Text(), item.Content.Text()),
+				GUID:        item.GUID.Text(),
+				Author:      firstNonEmpty(item.Author.Text(), item.Creator.Text()),
+				Image:       item.image(),
+				PublishedAt: parseFeedDate(item.PubDate.Text()),
+			})
+		}
+	case "feed":
+		for _, entry := range parsedFeed.Entries {
+			posts = append(posts, Post{
+				Title:       entry.Title.Text(),
+				Link:        entry.link(),
+				Description: firstNonEmpty(entry.Content.Text(), entry.Summary.Text()),
+				GUID:        entry.ID.Text(),
+				Author:      entry.Author.Name.Text(),
+				Image:       entry.image(),
+				PublishedAt: parseFeedDate(firstNonEmpty(entry.Published.Text(), entry.Updated.Text())),
+			})
+		}
+	default:
+		return nil, nil, errors.New("unknown feed format, root element is " + parsedFeed.XMLName.Local)
+	}
+
+	var validPosts []Post
+	report := &ParseReport{ItemsCount: len(posts)}
+	for i, post := range posts {
+		report.check(i, "link", post.Link != "" || post.GUID != "")
+		if post.Link == "" && post.GUID == "" {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("item %v skipped: it has neither link nor guid", i+1))
+			continue
+		}
+		validPosts = append(validPosts, post)
+	}
+	if len(validPosts) == 0 {
+		return nil, report, errors.New("can not find any item in the feed")
+	}
+	return validPosts, report, nil
+}
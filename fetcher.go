@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheValidators are response headers which let the next request
+// of the same source be conditional.
+type CacheValidators struct {
+	ETag         string `gorm:"column:etag"`
+	LastModified string
+}
+
+type DownloadInfo struct {
+	StatusCode  int
+	BytesCount  int
+	ContentType string
+	NotModified bool
+	Validators  CacheValidators
+}
+
+// Fetcher downloads channel sources. Its zero value uses http.DefaultClient
+// without any limits, Init configures it from FetcherConfig.
+type Fetcher struct {
+	client           *http.Client
+	maxBodySize      int64
+	userAgent        string
+	maxRetries       int
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+}
+
+func (fetcher *Fetcher) Init(config *FetcherConfig) error {
+	proxy := http.ProxyFromEnvironment
+	if config.Proxy != "" {
+		proxyUrl, err := url.Parse(config.Proxy)
+		if err != nil {
+			return errors.New("fetcher proxy parsing error: " + err.Error())
+		}
+		proxy = http.ProxyURL(proxyUrl)
+	}
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   config.ConnectTimeout.Duration,
+			KeepAlive: config.ConnectTimeout.Duration,
+		}).DialContext,
+		TLSHandshakeTimeout:   config.ConnectTimeout.Duration,
+		ResponseHeaderTimeout: config.ReadTimeout.Duration,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       config.RequestTimeout.Duration,
+	}
+	fetcher.client = &http.Client{Transport: transport, Timeout: config.RequestTimeout.Duration}
+	fetcher.maxBodySize = config.MaxBodySize
+	fetcher.userAgent = config.UserAgent
+	fetcher.maxRetries = config.MaxRetries
+	fetcher.retryInterval = config.RetryInterval.Duration
+	fetcher.maxRetryInterval = config.MaxRetryInterval.Duration
+	return nil
+}
+
+func (fetcher *Fetcher) httpClient() *http.Client {
+	if fetcher.client == nil {
+		return http.DefaultClient
+	}
+	return fetcher.client
+}
+
+func (config *RequestConfig) parseHeaders() (http.Header, error) {
+	headers := make(http.Header)
+	for _, line := range strings.Split(config.Headers, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		index := strings.Index(line, ":")
+		if index <= 0 {
+			return nil, errors.New("header '" + line + "' should look like 'Name: value'")
+		}
+		headers.Add(strings.TrimSpace(line[:index]), strings.TrimSpace(line[index+1:]))
+	}
+	return headers, nil
+}
+
+func (config *RequestConfig) parseCookies() ([]*http.Cookie, error) {
+	if strings.TrimSpace(config.Cookies) == "" {
+		return nil, nil
+	}
+	cookies := (&http.Request{Header: http.Header{"Cookie": {config.Cookies}}}).Cookies()
+	if len(cookies) == 0 {
+		return nil, errors.New("cookies should look like 'name=value; other=value'")
+	}
+	return cookies, nil
+}
+
+func (config *RequestConfig) Validate() error {
+	_, err := config.parseHeaders()
+	if err != nil {
+		return err
+	}
+	_, err = config.parseCookies()
+	if err != nil {
+		return err
+	}
+	if config.Password != "" && config.Username == "" {
+		return errors.New("password is set without username")
+	}
+	return nil
+}
+
+func (config *RequestConfig) apply(request *http.Request) error {
+	headers, err := config.parseHeaders()
+	if err != nil {
+		return err
+	}
+	for name, values := range headers {
+		request.Header[name] = values
+	}
+	cookies, err := config.parseCookies()
+	if err != nil {
+		return err
+	}
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	if config.Username != "" {
+		request.SetBasicAuth(config.Username, config.Password)
+	}
+	return nil
+}
+
+// FetchError is a download error which knows whether it is worth retrying.
+// Temporary errors are timeouts, transient network errors, 429 and 5xx responses.
+type FetchError struct {
+	Message    string
+	StatusCode int
+	Temporary  bool
+	RetryAfter time.Duration
+}
+
+func (err *FetchError) Error() string {
+	return err.Message
+}
+
+// wrapError prefixes the error message keeping FetchError details.
+func wrapError(prefix string, err error) error {
+	if fetchErr, ok := err.(*FetchError); ok {
+		wrappedErr := *fetchErr
+		wrappedErr.Message = prefix + fetchErr.Message
+		return &wrappedErr
+	}
+	return errors.New(prefix + err.Error())
+}
+
+// isTemporaryNetError tells timeouts and transient network errors from the ones
+// which retrying does not fix, like unknown hosts, refused connections or bad certificates.
+func isTemporaryNetError(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && (netErr.Timeout() || netErr.Temporary())
+}
+
+func IsTemporaryError(err error) bool {
+	fetchErr, ok := err.(*FetchError)
+	return ok && fetchErr.Temporary
+}
+
+// RetryAfter returns the delay the source asked to wait with Retry-After, if any.
+func RetryAfter(err error) time.Duration {
+	fetchErr, ok := err.(*FetchError)
+	if !ok {
+		return 0
+	}
+	return fetchErr.RetryAfter
+}
+
+// parseRetryAfter parses Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	retryAt, err := http.ParseTime(value)
+	if err != nil || !retryAt.After(now) {
+		return 0
+	}
+	return retryAt.Sub(now)
+}
+
+// RetryDelay returns the delay before the retry with the given number
+// or false if the error should not be retried before the next regular update.
+func (fetcher *Fetcher) RetryDelay(retry int, err error) (time.Duration, bool) {
+	fetchErr, ok := err.(*FetchError)
+	if !ok || !fetchErr.Temporary || retry > fetcher.maxRetries {
+		return 0, false
+	}
+	if fetchErr.RetryAfter > 0 {
+		return fetchErr.RetryAfter, fetchErr.RetryAfter <= fetcher.maxRetryInterval
+	}
+	delay := fetcher.retryInterval
+	for i := 1; i < retry && delay < fetcher.maxRetryInterval; i++ {
+		delay *= 2
+	}
+	if delay > fetcher.maxRetryInterval {
+		delay = fetcher.maxRetryInterval
+	}
+	return delay, true
+}
+
+// Download downloads the source with the channel request config, which may be nil.
+// Temporary errors are not retried here, the channels updater schedules the retry with RetryDelay.
+func (fetcher *Fetcher) Download(source string, validators CacheValidators, requestConfig *RequestConfig) ([]byte, *DownloadInfo, error) {
+	info := &DownloadInfo{}
+	request, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return nil, info, errors.New("downloading content error: " + err.Error())
+	}
+	if fetcher.userAgent != "" {
+		request.Header.Set("User-Agent", fetcher.userAgent)
+	}
+	if requestConfig != nil {
+		err = requestConfig.apply(request)
+		if err != nil {
+			return nil, info, errors.New("applying request config error: " + err.Error())
+		}
+	}
+	if validators.ETag != "" {
+		request.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		request.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+	result, err := fetcher.httpClient().Do(request)
+	if err != nil {
+		return nil, info, &FetchError{Message: "downloading content error: " + err.Error(), Temporary: isTemporaryNetError(err)}
+	}
+	defer result.Body.Close()
+	info.StatusCode = result.StatusCode
+	if result.StatusCode == http.StatusNotModified {
+		info.NotModified = true
+		info.Validators = validators
+		return nil, info, nil
+	}
+	if result.StatusCode < 200 || result.StatusCode >= 300 {
+		return nil, info, &FetchError{
+			Message:    fmt.Sprintf("downloading content error: unexpected status %v", result.Status),
+			StatusCode: result.StatusCode,
+			Temporary:  result.StatusCode == http.StatusTooManyRequests || result.StatusCode >= 500,
+			RetryAfter: parseRetryAfter(result.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	info.ContentType = result.Header.Get("Content-Type")
+	info.Validators = CacheValidators{
+		ETag:         result.Header.Get("ETag"),
+		LastModified: result.Header.Get("Last-Modified"),
+	}
+	var body io.Reader = result.Body
+	if fetcher.maxBodySize > 0 {
+		body = io.LimitReader(result.Body, fetcher.maxBodySize+1)
+	}
+	content, err := ioutil.ReadAll(body)
+	info.BytesCount = len(content)
+	if err != nil {
+		return nil, info, &FetchError{Message: "downloading content error: " + err.Error(), Temporary: isTemporaryNetError(err)}
+	}
+	if fetcher.maxBodySize > 0 && int64(len(content)) > fetcher.maxBodySize {
+		return nil, info, errors.New(fmt.Sprintf("downloading content error: body is larger than %v bytes", fetcher.maxBodySize))
+	}
+	return content, info, nil
+}
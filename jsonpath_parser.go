@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/oliveagle/jsonpath"
+	"strconv"
+)
+
+func jsonValueToString(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	default:
+		rawValue, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return string(rawValue), nil
+	}
+}
+
+func getContentByJSONPath(name string, item interface{}, path *jsonpath.Compiled) (string, error) {
+	if path == nil {
+		return "", nil
+	}
+	value, err := path.Lookup(item)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("can not find %v by jsonpath: %v", name, err.Error()))
+	}
+	if values, ok := value.([]interface{}); ok {
+		if len(values) != 1 {
+			return "", errors.New(fmt.Sprintf("empty or multiple %v by jsonpath", name))
+		}
+		value = values[0]
+	}
+	result, err := jsonValueToString(value)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("can not convert %v to string: %v", name, err.Error()))
+	}
+	return result, nil
+}
+
+func getOptionalContentByJSONPath(name string, item interface{}, path *jsonpath.Compiled) string {
+	value, err := getContentByJSONPath(name, item, path)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+func parseJSONPathContent(rule *CompiledRule, content []byte) ([]Post, *ParseReport, error) {
+	var document interface{}
+	err := json.Unmarshal(content, &document)
+	if err != nil {
+		return nil, nil, errors.New("json decoding error: " + err.Error())
+	}
+
+	found, err := rule.ItemPath.Lookup(document)
+	if err != nil {
+		return nil, nil, errors.New("can not find item by jsonpath: " + err.Error())
+	}
+	items, ok := found.([]interface{})
+	if !ok {
+		items = []interface{}{found}
+	}
+	if len(items) == 0 {
+		return nil, nil, errors.New("can not find item by jsonpath, no items")
+	}
+
+	return collectItems(rule, len(items), func(i int) *itemFields {
+		item := items[i]
+
+		var fields itemFields
+		fields.Title, fields.TitleErr = getContentByJSONPath("title", item, rule.TitlePath)
+		fields.Link, fields.LinkErr = getContentByJSONPath("link", item, rule.LinkPath)
+		fields.Description, fields.DescriptionErr = getContentByJSONPath("description", item, rule.DescriptionPath)
+		fields.Meta = postMeta{
+			Date:   getOptionalContentByJSONPath("date", item, rule.DatePath),
+			Author: getOptionalContentByJSONPath("author", item, rule.AuthorPath),
+			GUID:   getOptionalContentByJSONPath("guid", item, rule.GUIDPath),
+			Image:  getOptionalContentByJSONPath("image", item, rule.ImagePath),
+		}
+		return &fields
+	})
+}
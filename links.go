@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// TrackingParamPrefixes are query parameters which only tell the site where the visitor came from.
+var TrackingParamPrefixes = []string{"utm_", "fbclid", "gclid", "yclid", "_openstat", "mc_cid", "mc_eid"}
+
+var baseHrefPattern = regexp.MustCompile(`(?is)<base\s[^>]*?href\s*=\s*["']([^"']+)["']`)
+
+func canonicalizeURL(parsedLink *url.URL) {
+	parsedLink.Scheme = strings.ToLower(parsedLink.Scheme)
+	parsedLink.Host = strings.ToLower(parsedLink.Host)
+	if port := parsedLink.Port(); port != "" && defaultPorts[parsedLink.Scheme] == port {
+		parsedLink.Host = parsedLink.Hostname()
+	}
+}
+
+func isTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, prefix := range TrackingParamPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func stripTrackingParams(parsedLink *url.URL) {
+	if parsedLink.RawQuery == "" {
+		return
+	}
+	var params []string
+	for _, param := range strings.Split(parsedLink.RawQuery, "&") {
+		name := param
+		if index := strings.Index(param, "="); index != -1 {
+			name = param[:index]
+		}
+		if unescapedName, err := url.QueryUnescape(name); err == nil {
+			name = unescapedName
+		}
+		if !isTrackingParam(name) {
+			params = append(params, param)
+		}
+	}
+	parsedLink.RawQuery = strings.Join(params, "&")
+}
+
+// DocumentBase returns the URL relative links of the document are resolved against:
+// the source itself or the <base href> of an HTML document.
+func DocumentBase(source string, content []byte, isHtml bool) *url.URL {
+	base, err := url.Parse(strings.TrimSpace(source))
+	if err != nil {
+		return nil
+	}
+	if !isHtml {
+		return base
+	}
+	head := content
+	if index := strings.Index(strings.ToLower(string(content)), "<body"); index != -1 {
+		head = content[:index]
+	}
+	match := baseHrefPattern.FindSubmatch(head)
+	if match == nil {
+		return base
+	}
+	baseHref, err := url.Parse(strings.TrimSpace(string(match[1])))
+	if err != nil {
+		return base
+	}
+	return base.ResolveReference(baseHref)
+}
+
+// ResolveLink makes the link absolute with canonical scheme and host,
+// optionally without tracking query parameters. Unparsable links are kept as is.
+func ResolveLink(base *url.URL, link string, withoutTracking bool) string {
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return link
+	}
+	parsedLink, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	if base != nil {
+		parsedLink = base.ResolveReference(parsedLink)
+	}
+	canonicalizeURL(parsedLink)
+	if withoutTracking {
+		stripTrackingParams(parsedLink)
+	}
+	return parsedLink.String()
+}
+
+func NormalizeLink(link string) string {
+	link = strings.TrimSpace(link)
+	parsedLink, err := url.Parse(link)
+	if err != nil || parsedLink.Host == "" {
+		return link
+	}
+	canonicalizeURL(parsedLink)
+	parsedLink.Fragment = ""
+	parsedLink.Path = strings.TrimRight(parsedLink.Path, "/")
+	parsedLink.RawPath = ""
+	return parsedLink.String()
+}
+
+// SameOrigin tells whether both URLs have the same scheme, host and port.
+func SameOrigin(first, second string) bool {
+	firstUrl, err := url.Parse(strings.TrimSpace(first))
+	if err != nil || firstUrl.Host == "" {
+		return false
+	}
+	secondUrl, err := url.Parse(strings.TrimSpace(second))
+	if err != nil {
+		return false
+	}
+	canonicalizeURL(firstUrl)
+	canonicalizeURL(secondUrl)
+	return firstUrl.Scheme == secondUrl.Scheme && firstUrl.Host == secondUrl.Host
+}
+
+// PostIdentity identifies a post within its channel across refreshes.
+func PostIdentity(post *Post) string {
+	if post.GUID != "" {
+		return "guid:" + post.GUID
+	}
+	return "link:" + NormalizeLink(post.Link)
+}
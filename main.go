@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 )
@@ -19,25 +21,14 @@ type ChannelState struct {
 const ConfigPath = "prod.config"
 var dbApi DBApi
 var templater Templater
+var channelsUpdater ChannelsUpdater
+var fetcher Fetcher
 var upgrader = websocket.Upgrader{}
 
 func Redirect(w http.ResponseWriter, r *http.Request, url string) {
 	fmt.Fprintf(w, `<html><head></head><body><script>window.location.replace("%v")</script></body></html>`, url)
 }
 
-func UpdateChannelContent(channelId uint) {
-	err := dbApi.UpdateChannelContent(channelId)
-	if err != nil {
-		log.Println("updating channel error: " + err.Error())
-		err = dbApi.MarkChannelAsBroken(channelId)
-		log.Printf("mark channel %v as broken", channelId)
-		if err != nil {
-			log.Println("marking channel as broken error: " + err.Error())
-		}
-		log.Println(fmt.Sprintf("channel %v marked as broken due to getting content error", channelId))
-	}
-}
-
 func IndexHandler(writer http.ResponseWriter, request *http.Request) {
 	tmpl := templater.GetTemplate("index")
 	tmpl.Execute(writer, struct{ Channels []Channel }{Channels: dbApi.ListChannels()})
@@ -45,7 +36,60 @@ func IndexHandler(writer http.ResponseWriter, request *http.Request) {
 
 func NewChannelPageHandler(writer http.ResponseWriter, request *http.Request) {
 	tmpl := templater.GetTemplate("newchannel")
-	tmpl.Execute(writer, struct{ Channels []Channel }{Channels: dbApi.ListChannels()})
+	tmpl.Execute(writer, struct {
+		Channels  []Channel
+		Templates []RuleTemplate
+	}{Channels: dbApi.ListChannels(), Templates: dbApi.ListRuleTemplates()})
+}
+
+// ruleIdFromForm returns the ID of the rule template chosen in the form or 0 if there is none.
+func ruleIdFromForm(form url.Values) uint {
+	ruleId, err := strconv.ParseUint(form.Get("rule_id"), 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint(ruleId)
+}
+
+// ruleFromForm builds a rule from the fields of the new channel form.
+func ruleFromForm(form url.Values) (*Rule, error) {
+	for _, field := range []string{"item_pattern", "link_pattern", "title_pattern", "description_pattern"} {
+		if _, ok := form[field]; !ok {
+			return nil, errors.New("form error: no " + field)
+		}
+	}
+	rule := Rule{
+		Name:                form.Get("rule_name"),
+		Kind:                form.Get("rule_kind"),
+		ItemPattern:         form.Get("item_pattern"),
+		LinkPattern:         form.Get("link_pattern"),
+		TitlePattern:        form.Get("title_pattern"),
+		DescriptionPattern:  form.Get("description_pattern"),
+		DatePattern:         form.Get("date_pattern"),
+		DateLayout:          form.Get("date_layout"),
+		AuthorPattern:       form.Get("author_pattern"),
+		GUIDPattern:         form.Get("guid_pattern"),
+		ImagePattern:        form.Get("image_pattern"),
+		StripTrackingParams: form.Get("strip_tracking_params") != "",
+		OptionalFields:      form.Get("optional_fields"),
+	}
+	if rawMaxBadItemsShare := form.Get("max_bad_items_share"); rawMaxBadItemsShare != "" {
+		var err error
+		rule.MaxBadItemsShare, err = strconv.ParseFloat(rawMaxBadItemsShare, 64)
+		if err != nil {
+			return nil, errors.New("form error, bad max bad items share: " + err.Error())
+		}
+	}
+	return &rule, nil
+}
+
+func requestConfigFromForm(form url.Values) RequestConfig {
+	return RequestConfig{
+		Headers:  form.Get("request_headers"),
+		Cookies:  form.Get("request_cookies"),
+		Username: form.Get("request_username"),
+		Password: form.Get("request_password"),
+	}
 }
 
 func AddChannelHandler(writer http.ResponseWriter, request *http.Request) {
@@ -63,40 +107,370 @@ func AddChannelHandler(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	itemPattern, ok := request.Form["item_pattern"]
-	if !ok {
+	rule, err := ruleFromForm(request.Form)
+	if err != nil {
+		log.Println("Creating channel error: " + err.Error())
 		Redirect(writer, request, "/")
 		return
 	}
+	var refreshInterval time.Duration
+	if rawRefreshInterval := request.Form.Get("refresh_interval"); rawRefreshInterval != "" {
+		refreshInterval, err = time.ParseDuration(rawRefreshInterval)
+		if err != nil {
+			log.Println("Creating channel error, bad refresh interval: " + err.Error())
+			Redirect(writer, request, "/")
+			return
+		}
+	}
+	_, err = dbApi.CreateChannel(Channel{
+		Name:            channelName[0],
+		Source:          channelSource[0],
+		Rule:            *rule,
+		RuleID:          ruleIdFromForm(request.Form),
+		RefreshInterval: refreshInterval,
+		RequestConfig:   requestConfigFromForm(request.Form),
+	})
+	if err != nil {
+		log.Println("Creating channel error: " + err.Error())
+		Redirect(writer, request, "/")
+		return
+	}
+	channelsUpdater.Wake()
+	Redirect(writer, request, "/")
+}
 
-	linkPattern, ok := request.Form["link_pattern"]
-	if !ok {
+func EditChannelPageHandler(writer http.ResponseWriter, request *http.Request) {
+	channelId, err := strconv.ParseUint(request.URL.Path[len("/editchannel/"):], 10, 32)
+	if err != nil {
+		log.Println("editing channel error, bad channel id: " + err.Error())
+		Redirect(writer, request, "/")
+		return
+	}
+	channel, err := dbApi.GetChannelById(uint(channelId))
+	if err != nil {
+		log.Println("editing channel error: " + err.Error())
 		Redirect(writer, request, "/")
 		return
 	}
+	var refreshInterval string
+	if channel.RefreshInterval > 0 {
+		refreshInterval = channel.RefreshInterval.String()
+	}
+	channels := dbApi.ListChannels()
+	var ruleChannelsCount int
+	for _, ruleChannel := range channels {
+		if ruleChannel.RuleID == channel.RuleID {
+			ruleChannelsCount++
+		}
+	}
+	tmpl := templater.GetTemplate("editchannel")
+	tmpl.Execute(writer, struct {
+		Channels          []Channel
+		Channel           *Channel
+		RefreshInterval   string
+		Templates         []RuleTemplate
+		RuleChannelsCount int
+	}{
+		Channels:          channels,
+		Channel:           channel,
+		RefreshInterval:   refreshInterval,
+		Templates:         dbApi.ListRuleTemplates(),
+		RuleChannelsCount: ruleChannelsCount,
+	})
+}
 
-	titlePattern, ok := request.Form["title_pattern"]
-	if !ok {
+// UpdateChannelHandler saves the edited channel keeping its posts,
+// the stored request settings are replaced only if it is asked explicitly.
+func UpdateChannelHandler(writer http.ResponseWriter, request *http.Request) {
+	strChannelId := request.URL.Path[len("/updatechannel/"):]
+	channelId, err := strconv.ParseUint(strChannelId, 10, 32)
+	if err != nil {
+		log.Println("updating channel error, bad channel id: " + err.Error())
 		Redirect(writer, request, "/")
 		return
 	}
+	request.ParseForm()
+	editPage := "/editchannel/" + strChannelId
 
-	descriptionPattern, ok := request.Form["description_pattern"]
-	if !ok {
+	rule, err := ruleFromForm(request.Form)
+	if err != nil {
+		log.Println("updating channel error: " + err.Error())
+		Redirect(writer, request, editPage)
+		return
+	}
+	var refreshInterval time.Duration
+	if rawRefreshInterval := request.Form.Get("refresh_interval"); rawRefreshInterval != "" {
+		refreshInterval, err = time.ParseDuration(rawRefreshInterval)
+		if err != nil {
+			log.Println("updating channel error, bad refresh interval: " + err.Error())
+			Redirect(writer, request, editPage)
+			return
+		}
+	}
+	var requestConfig *RequestConfig
+	if request.Form.Get("replace_request_config") != "" {
+		formRequestConfig := requestConfigFromForm(request.Form)
+		requestConfig = &formRequestConfig
+	}
+	channel := Channel{
+		Name:            request.Form.Get("channel_name"),
+		Source:          request.Form.Get("channel_source"),
+		Rule:            *rule,
+		RuleID:          ruleIdFromForm(request.Form),
+		RefreshInterval: refreshInterval,
+	}
+	channel.ID = uint(channelId)
+	_, err = dbApi.UpdateChannel(channel, requestConfig, request.Form.Get("author"))
+	if err != nil {
+		log.Println("updating channel error: " + err.Error())
+		Redirect(writer, request, editPage)
+		return
+	}
+	channelsUpdater.Wake()
+	Redirect(writer, request, "/channels/"+strChannelId)
+}
+
+// RuleHistoryEntry is a rule version with the changes it made to the previous one.
+type RuleHistoryEntry struct {
+	RuleVersion
+	Number             int
+	RestoredFromNumber int
+	Changes            []RuleFieldChange
+}
+
+// ruleHistory numbers the versions, which go latest first, and diffs each with the previous one.
+func ruleHistory(versions []RuleVersion) ([]RuleHistoryEntry, error) {
+	numbers := make(map[uint]int)
+	for i, version := range versions {
+		numbers[version.ID] = len(versions) - i
+	}
+	var entries []RuleHistoryEntry
+	for i, version := range versions {
+		entry := RuleHistoryEntry{
+			RuleVersion:        version,
+			Number:             numbers[version.ID],
+			RestoredFromNumber: numbers[version.RestoredFrom],
+		}
+		rule, err := version.Rule()
+		if err != nil {
+			return nil, err
+		}
+		previousRule := &Rule{}
+		if i+1 < len(versions) {
+			previousRule, err = versions[i+1].Rule()
+			if err != nil {
+				return nil, err
+			}
+		}
+		entry.Changes = DiffRules(previousRule, rule)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func RuleHistoryPageHandler(writer http.ResponseWriter, request *http.Request) {
+	ruleId, err := strconv.ParseUint(request.URL.Path[len("/rulehistory/"):], 10, 32)
+	if err != nil {
+		log.Println("getting rule history error, bad rule id: " + err.Error())
 		Redirect(writer, request, "/")
 		return
 	}
-	channel, err := dbApi.CreateChannel(channelName[0], channelSource[0], itemPattern[0], linkPattern[0], titlePattern[0], descriptionPattern[0])
+	history, err := ruleHistory(dbApi.GetRuleHistory(uint(ruleId)))
 	if err != nil {
-		log.Println("Creating channel error: " + err.Error())
+		log.Println("getting rule history error: " + err.Error())
 	}
-	go UpdateChannelContent(channel.ID)
-	Redirect(writer, request, "/")
+	channels := dbApi.ListChannels()
+	var ruleChannels []Channel
+	for _, channel := range channels {
+		if channel.RuleID == uint(ruleId) {
+			ruleChannels = append(ruleChannels, channel)
+		}
+	}
+	tmpl := templater.GetTemplate("rulehistory")
+	tmpl.Execute(writer, struct {
+		Channels     []Channel
+		RuleID       uint64
+		RuleChannels []Channel
+		History      []RuleHistoryEntry
+	}{Channels: channels, RuleID: ruleId, RuleChannels: ruleChannels, History: history})
+}
+
+func RollbackRuleHandler(writer http.ResponseWriter, request *http.Request) {
+	strRuleId := request.URL.Path[len("/rollbackrule/"):]
+	ruleId, err := strconv.ParseUint(strRuleId, 10, 32)
+	if err != nil {
+		log.Println("rolling back rule error, bad rule id: " + err.Error())
+		Redirect(writer, request, "/")
+		return
+	}
+	request.ParseForm()
+	versionId, err := strconv.ParseUint(request.Form.Get("version_id"), 10, 32)
+	if err != nil {
+		log.Println("rolling back rule error, bad version id: " + err.Error())
+		Redirect(writer, request, "/rulehistory/"+strRuleId)
+		return
+	}
+	_, err = dbApi.RollbackRule(uint(ruleId), uint(versionId), request.Form.Get("author"))
+	if err != nil {
+		log.Println("rolling back rule error: " + err.Error())
+	} else {
+		channelsUpdater.Wake()
+	}
+	Redirect(writer, request, "/rulehistory/"+strRuleId)
+}
+
+// dryRunRequestConfig chooses the request settings to test the rule of the edited channel with.
+// The stored settings may contain secrets, so they are used only unless they are replaced
+// and only if the tested source has the same origin as the channel source.
+func dryRunRequestConfig(form url.Values, channel *Channel, storedRequestConfig *RequestConfig) RequestConfig {
+	if form.Get("replace_request_config") != "" || !SameOrigin(channel.Source, form.Get("channel_source")) {
+		return requestConfigFromForm(form)
+	}
+	return *storedRequestConfig
+}
+
+// dryRunForm tests the rule of the new or edit channel form. A chosen template is tested
+// as is, unless it is the current rule of the edited channel, which the form patterns change.
+func dryRunForm(form url.Values) *RuleTestResult {
+	rule, err := ruleFromForm(form)
+	if err != nil {
+		return &RuleTestResult{Error: err.Error(), Posts: []Post{}}
+	}
+	requestConfig := requestConfigFromForm(form)
+	var channel *Channel
+	channelId, err := strconv.ParseUint(form.Get("channel_id"), 10, 32)
+	if err == nil {
+		channel, err = dbApi.GetChannelById(uint(channelId))
+		if err != nil {
+			return &RuleTestResult{Error: err.Error(), Posts: []Post{}}
+		}
+		storedRequestConfig, err := dbApi.GetChannelRequestConfig(channel.ID)
+		if err != nil {
+			return &RuleTestResult{Error: err.Error(), Posts: []Post{}}
+		}
+		requestConfig = dryRunRequestConfig(form, channel, storedRequestConfig)
+	}
+	if ruleId := ruleIdFromForm(form); ruleId != 0 && (channel == nil || channel.RuleID != ruleId) {
+		rule, err = dbApi.GetRuleTemplate(ruleId)
+		if err != nil {
+			return &RuleTestResult{Error: err.Error(), Posts: []Post{}}
+		}
+	}
+	return DryRunRule(form.Get("channel_source"), rule, &requestConfig)
+}
+
+// DryRunRuleHandler runs the rule from the new or edit channel form against its source
+// without saving anything and responds with the parsed posts and pattern diagnostics.
+func DryRunRuleHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	request.ParseForm()
+
+	rawResult, err := json.Marshal(dryRunForm(request.Form))
+	if err != nil {
+		log.Println("marshalling rule test result error: " + err.Error())
+		http.Error(writer, "marshalling error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(rawResult)
+}
+
+func RuleTemplatesPageHandler(writer http.ResponseWriter, request *http.Request) {
+	tmpl := templater.GetTemplate("ruletemplates")
+	tmpl.Execute(writer, struct {
+		Channels  []Channel
+		Templates []RuleTemplate
+	}{Channels: dbApi.ListChannels(), Templates: dbApi.ListRuleTemplates()})
+}
+
+func EditRulePageHandler(writer http.ResponseWriter, request *http.Request) {
+	ruleId, err := strconv.ParseUint(request.URL.Path[len("/editrule/"):], 10, 32)
+	if err != nil {
+		log.Println("editing rule error, bad rule id: " + err.Error())
+		Redirect(writer, request, "/rules")
+		return
+	}
+	rule, err := dbApi.GetRule(uint(ruleId))
+	if err != nil {
+		log.Println("editing rule error: " + err.Error())
+		Redirect(writer, request, "/rules")
+		return
+	}
+	channels := dbApi.ListChannels()
+	var ruleChannels []Channel
+	for _, channel := range channels {
+		if channel.RuleID == rule.ID {
+			ruleChannels = append(ruleChannels, channel)
+		}
+	}
+	tmpl := templater.GetTemplate("editrule")
+	tmpl.Execute(writer, struct {
+		Channels     []Channel
+		Rule         *Rule
+		RuleChannels []Channel
+	}{Channels: channels, Rule: rule, RuleChannels: ruleChannels})
+}
+
+// UpdateRuleHandler saves the edited rule, every channel using it is updated right away.
+func UpdateRuleHandler(writer http.ResponseWriter, request *http.Request) {
+	strRuleId := request.URL.Path[len("/updaterule/"):]
+	ruleId, err := strconv.ParseUint(strRuleId, 10, 32)
+	if err != nil {
+		log.Println("updating rule error, bad rule id: " + err.Error())
+		Redirect(writer, request, "/rules")
+		return
+	}
+	request.ParseForm()
+	rule, err := ruleFromForm(request.Form)
+	if err != nil {
+		log.Println("updating rule error: " + err.Error())
+		Redirect(writer, request, "/editrule/"+strRuleId)
+		return
+	}
+	rule.ID = uint(ruleId)
+	_, err = dbApi.UpdateRule(*rule, request.Form.Get("author"))
+	if err != nil {
+		log.Println("updating rule error: " + err.Error())
+		Redirect(writer, request, "/editrule/"+strRuleId)
+		return
+	}
+	channelsUpdater.Wake()
+	Redirect(writer, request, "/rules")
 }
 
 func ViewChannelHandlerPage(writer http.ResponseWriter, request *http.Request) {
+	var fetchHistory []FetchAttempt
+	channelId, err := strconv.ParseUint(request.URL.Path[len("/channels/"):], 10, 32)
+	if err == nil {
+		fetchHistory = dbApi.GetFetchHistory(uint(channelId))
+	}
 	tmpl := templater.GetTemplate("viewchannel")
-	tmpl.Execute(writer, struct{ Channels []Channel }{Channels: dbApi.ListChannels()})
+	tmpl.Execute(writer, struct {
+		Channels     []Channel
+		ChannelID    uint64
+		FetchHistory []FetchAttempt
+	}{Channels: dbApi.ListChannels(), ChannelID: channelId, FetchHistory: fetchHistory})
+}
+
+func FetchHistoryHandler(writer http.ResponseWriter, request *http.Request) {
+	strChannelId := request.URL.Path[len("/fetchhistory/"):]
+	channelId, err := strconv.ParseUint(strChannelId, 10, 32)
+	if err != nil {
+		log.Println("getting fetch history error, bad channel id: " + err.Error())
+		http.Error(writer, "bad channel id", http.StatusBadRequest)
+		return
+	}
+	rawHistory, err := json.Marshal(dbApi.GetFetchHistory(uint(channelId)))
+	if err != nil {
+		log.Println("marshalling fetch history error: " + err.Error())
+		http.Error(writer, "marshalling error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(rawHistory)
 }
 
 func GetChannelContent(w http.ResponseWriter, r *http.Request) {
@@ -155,10 +529,15 @@ func StartServer(configPath string) error {
 	if err != nil {
 		return err
 	}
+	err = fetcher.Init(&config.FetcherConfig)
+	if err != nil {
+		return err
+	}
 	dbApi.Init(&config.PostgresConfig, config.AddExamples)
 	templater.Init(config.TemplatesPath)
 	defer dbApi.db.Close()
-	go RunUpdater(&dbApi, time.Hour*1, time.Second*3)
+	channelsUpdater.Init(&dbApi, &config.UpdaterConfig)
+	go channelsUpdater.Run()
 
 	staticDir := fmt.Sprintf("/%v/", config.StaticPath)
 	http.Handle(staticDir, http.StripPrefix(staticDir, http.FileServer(http.Dir(config.StaticPath))))
@@ -166,8 +545,22 @@ func StartServer(configPath string) error {
 	http.HandleFunc("/", IndexHandler)
 	http.HandleFunc("/newchannel", NewChannelPageHandler)
 	http.HandleFunc("/addchannel", AddChannelHandler)
+	http.HandleFunc("/testrule", DryRunRuleHandler)
 	http.HandleFunc("/deletechannel/", DeleteChannelHandler)
+	http.HandleFunc("/editchannel/", EditChannelPageHandler)
+	http.HandleFunc("/updatechannel/", UpdateChannelHandler)
+	http.HandleFunc("/rulehistory/", RuleHistoryPageHandler)
+	http.HandleFunc("/rules", RuleTemplatesPageHandler)
+	http.HandleFunc("/editrule/", EditRulePageHandler)
+	http.HandleFunc("/updaterule/", UpdateRuleHandler)
+	http.HandleFunc("/rollbackrule/", RollbackRuleHandler)
 	http.HandleFunc("/channels/", ViewChannelHandlerPage)
+	http.HandleFunc("/fetchhistory/", FetchHistoryHandler)
+	http.HandleFunc(APIPrefix+"/channels", ChannelsAPIHandler)
+	http.HandleFunc(APIPrefix+"/channels/", ChannelsAPIHandler)
+	http.HandleFunc(APIPrefix+"/posts", PostsAPIHandler)
+	http.HandleFunc(APIPrefix+"/rules", RulesAPIHandler)
+	http.HandleFunc(APIPrefix+"/rules/", RulesAPIHandler)
 	http.HandleFunc("/ws", GetChannelContent)
 	http.HandleFunc("/favicon.ico", func(writer http.ResponseWriter, request *http.Request) {})
 	log.Println("start server")
@@ -4,89 +4,315 @@ import (
 	"errors"
 	"fmt"
 	"html"
-	"io/ioutil"
 	"log"
-	"net/http"
+	"net/url"
 	"regexp"
 )
 
 //var itemPattern = regexp.MustCompile("(?s)<article\\sclass=\"post\\spost_preview\">(.*?)</article>")
 
-func DownloadContent(source string) ([]byte, error) {
-	result, err := http.Get(source)
-	if err != nil {
-		return nil, errors.New("downloading content error: " + err.Error())
-	}
-	defer result.Body.Close()
-	content, err := ioutil.ReadAll(result.Body)
-	if err != nil {
-		return nil, errors.New("downloading content error: " + err.Error())
-	}
-	return content, nil
+// DownloadContent downloads the source unless it is not modified since the response
+// the validators came from. In that case it returns no content and info.NotModified.
+func DownloadContent(source string, validators CacheValidators, requestConfig *RequestConfig) ([]byte, *DownloadInfo, error) {
+	return fetcher.Download(source, validators, requestConfig)
 }
 
-func getContentByRegexp(name string, value []byte, regexp *regexp.Regexp) (*string, error) {
+func getContentByRegexp(name string, value []byte, regexp *regexp.Regexp) (string, error) {
 	titleIndexes := regexp.FindAllStringSubmatchIndex(string(value), -1)
 	if len(titleIndexes) != 1 {
-		return nil, errors.New(fmt.Sprintf("empty or multiple %v by regexp", name))
+		return "", errors.New(fmt.Sprintf("empty or multiple %v by regexp", name))
 	}
 	titleIndex := titleIndexes[0]
 	if len(titleIndex) < 4 {
-		return nil, errors.New(fmt.Sprintf("empty or multiple %v by regexp", name))
+		return "", errors.New(fmt.Sprintf("empty or multiple %v by regexp", name))
 	}
-	result := string(value[titleIndex[2]:titleIndex[3]])
-	return &result, nil
+	return string(value[titleIndex[2]:titleIndex[3]]), nil
 }
 
-func ParseContent(rule *CompiledRule, content []byte) ([]Post, error) {
+type postMeta struct {
+	Date   string
+	Author string
+	GUID   string
+	Image  string
+}
+
+func (meta *postMeta) value(name string) string {
+	switch name {
+	case "date":
+		return meta.Date
+	case "author":
+		return meta.Author
+	case "guid":
+		return meta.GUID
+	case "image":
+		return meta.Image
+	}
+	return ""
+}
+
+// newPost makes a post of the item fields. The date is optional, so an unparsable one
+// does not make the item bad: the post is kept without it and the error is returned as a warning.
+func newPost(rule *CompiledRule, title, link, description string, meta postMeta) (*Post, error) {
+	publishedAt, dateErr := rule.ParseDate(meta.Date)
+	post := Post{
+		Title:       title,
+		Link:        link,
+		Description: description,
+		GUID:        meta.GUID,
+		Author:      meta.Author,
+		Image:       meta.Image,
+		PublishedAt: publishedAt,
+	}
+	return &post, dateErr
+}
+
+func getOptionalContentByRegexp(value []byte, regexp *regexp.Regexp) string {
+	if regexp == nil {
+		return ""
+	}
+	match := regexp.FindSubmatch(value)
+	if len(match) < 2 {
+		return ""
+	}
+	return string(match[1])
+}
+
+// PatternReport tells on how many items a pattern matched and on which it did not.
+type PatternReport struct {
+	Matched     int
+	FailedItems []int
+}
+
+// ParseReport describes how the rule patterns matched the items of the content.
+type ParseReport struct {
+	ItemsCount int
+	Patterns   map[string]*PatternReport
+	Warnings   []string
+}
+
+func (report *ParseReport) check(index int, name string, matched bool) {
+	if report.Patterns == nil {
+		report.Patterns = make(map[string]*PatternReport)
+	}
+	pattern, ok := report.Patterns[name]
+	if !ok {
+		pattern = &PatternReport{FailedItems: []int{}}
+		report.Patterns[name] = pattern
+	}
+	if matched {
+		pattern.Matched++
+	} else {
+		pattern.FailedItems = append(pattern.FailedItems, index+1)
+	}
+}
+
+// itemFields are the values an item parser found by the rule patterns.
+type itemFields struct {
+	Title          string
+	TitleErr       error
+	Link           string
+	LinkErr        error
+	Description    string
+	DescriptionErr error
+	Meta           postMeta
+}
+
+// checkItem records which patterns failed on the item and makes a post of it.
+// Every pattern is checked, so the report is complete even for bad items.
+func (report *ParseReport) checkItem(rule *CompiledRule, index int, fields *itemFields) (*Post, error) {
+	report.check(index, "title", fields.TitleErr == nil)
+	report.check(index, "link", fields.LinkErr == nil)
+	report.check(index, "description", fields.DescriptionErr == nil)
+	for _, name := range rule.OptionalPatterns {
+		value := fields.Meta.value(name)
+		matched := value != ""
+		if name == "date" && matched {
+			_, err := rule.ParseDate(value)
+			matched = err == nil
+		}
+		report.check(index, name, matched)
+	}
+
+	switch {
+	case fields.TitleErr != nil && !rule.OptionalTitle:
+		return nil, fields.TitleErr
+	case fields.LinkErr != nil:
+		return nil, fields.LinkErr
+	case fields.DescriptionErr != nil && !rule.OptionalDescription:
+		return nil, fields.DescriptionErr
+	}
+	post, dateErr := newPost(rule, fields.Title, fields.Link, fields.Description, fields.Meta)
+	if dateErr != nil {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("item %v kept without date: %v", index+1, dateErr.Error()))
+	}
+	return post, nil
+}
+
+// collectItems parses every item skipping the bad ones, which are reported as warnings.
+// It fails only if the share of bad items exceeds the rule tolerance.
+func collectItems(rule *CompiledRule, itemsCount int, parseItem func(index int) *itemFields) ([]Post, *ParseReport, error) {
 	var posts []Post
+	var firstErr error
+	var badCount int
+	report := &ParseReport{ItemsCount: itemsCount}
+	for i := 0; i < itemsCount; i++ {
+		post, err := report.checkItem(rule, i, parseItem(i))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			badCount++
+			report.Warnings = append(report.Warnings, fmt.Sprintf("item %v skipped: %v", i+1, err.Error()))
+			continue
+		}
+		posts = append(posts, *post)
+	}
+	if badCount == 0 {
+		return posts, report, nil
+	}
+	if rule.MaxBadItemsShare == 0 {
+		return nil, report, firstErr
+	}
+	if float64(badCount) > rule.MaxBadItemsShare*float64(itemsCount) || len(posts) == 0 {
+		return nil, report, errors.New(fmt.Sprintf("%v of %v items are bad, first error: %v", badCount, itemsCount, firstErr.Error()))
+	}
+	return posts, report, nil
+}
+
+func ParseContent(rule *CompiledRule, content []byte) ([]Post, error) {
+	posts, _, err := ParseContentWithReport(rule, content)
+	return posts, err
+}
+
+// ParseContentWithReport also tells how the patterns matched and which items were skipped.
+// The report is nil if the content could not be split into items.
+func ParseContentWithReport(rule *CompiledRule, content []byte) ([]Post, *ParseReport, error) {
+	switch rule.Kind {
+	case FeedRuleKind:
+		return parseFeedContent(content)
+	case SelectorRuleKind:
+		return parseSelectorContent(rule, content)
+	case JSONPathRuleKind:
+		return parseJSONPathContent(rule, content)
+	case XPathRuleKind:
+		return parseXPathContent(rule, content)
+	default:
+		return parseRegexpContent(rule, content)
+	}
+}
+
+func parseRegexpContent(rule *CompiledRule, content []byte) ([]Post, *ParseReport, error) {
 	itemPattern := rule.ItemPattern
 
 	indexes := itemPattern.FindAllSubmatchIndex(content, -1)
 
 	if len(indexes) == 0 {
-		return nil, errors.New("can not find item by regexp, len(indexes) = 0")
+		return nil, nil, errors.New("can not find item by regexp, len(indexes) = 0")
 	}
 	for _, index := range indexes {
 		if len(index) < 4 {
 			log.Println(len(content))
 			log.Println(index)
-			return nil, errors.New(fmt.Sprintf("can not find item by regexp, len(index) = %d", len(index)))
-		}
-		itemLowerIndex := index[2]
-		itemUpperIndex := index[3]
-		itemContent := content[itemLowerIndex:itemUpperIndex]
-
-		title, err := getContentByRegexp("title", itemContent, &rule.TitlePattern)
-		if err != nil {
-			return nil, errors.New(err.Error())
-		}
-
-		link, err := getContentByRegexp("link", itemContent, &rule.LinkPattern)
-		if err != nil {
-			return nil, errors.New(err.Error())
+			return nil, nil, errors.New(fmt.Sprintf("can not find item by regexp, len(index) = %d", len(index)))
 		}
+	}
+	return collectItems(rule, len(indexes), func(i int) *itemFields {
+		itemContent := content[indexes[i][2]:indexes[i][3]]
 
-		description, err := getContentByRegexp("description", itemContent, &rule.DescriptionPattern)
-		if err != nil {
-			return nil, errors.New(err.Error())
+		var fields itemFields
+		fields.Title, fields.TitleErr = getContentByRegexp("title", itemContent, &rule.TitlePattern)
+		fields.Link, fields.LinkErr = getContentByRegexp("link", itemContent, &rule.LinkPattern)
+		fields.Description, fields.DescriptionErr = getContentByRegexp("description", itemContent, &rule.DescriptionPattern)
+		fields.Meta = postMeta{
+			Date:   getOptionalContentByRegexp(itemContent, rule.DatePattern),
+			Author: getOptionalContentByRegexp(itemContent, rule.AuthorPattern),
+			GUID:   getOptionalContentByRegexp(itemContent, rule.GUIDPattern),
+			Image:  getOptionalContentByRegexp(itemContent, rule.ImagePattern),
 		}
+		return &fields
+	})
+}
 
-		posts = append(posts, Post{Title: string(*title), Link: string(*link), Description: string(*description)})
+func resolvePostLinks(posts []Post, base *url.URL, withoutTracking bool) {
+	for i := range posts {
+		posts[i].Link = ResolveLink(base, posts[i].Link, withoutTracking)
+		posts[i].Image = ResolveLink(base, posts[i].Image, withoutTracking)
 	}
-	return posts, nil
 }
 
 func GetContent(source string, rule *CompiledRule) ([]Post, error) {
-	content, err := DownloadContent(source)
+	posts, _, err := GetContentWithInfo(source, rule, CacheValidators{}, nil)
+	return posts, err
+}
+
+// ContentInfo describes how the content was downloaded and parsed.
+type ContentInfo struct {
+	DownloadInfo
+	ParseReport
+}
+
+// GetContentWithInfo returns no posts without an error if the source is not modified.
+func GetContentWithInfo(source string, rule *CompiledRule, validators CacheValidators, requestConfig *RequestConfig) ([]Post, *ContentInfo, error) {
+	content, downloadInfo, err := DownloadContent(source, validators, requestConfig)
+	info := &ContentInfo{DownloadInfo: *downloadInfo}
+	if err != nil {
+		return nil, info, wrapError("getting content error: ", err)
+	}
+	if info.NotModified {
+		return nil, info, nil
+	}
+	content, err = DecodeContent(content, info.ContentType)
 	if err != nil {
-		return nil, errors.New("getting content error: " + err.Error())
+		return nil, info, errors.New("getting content error: " + err.Error())
 	}
 
-	content = []byte(html.UnescapeString(string(content)))
-	posts, err := ParseContent(rule, content)
+	// Regexps are written against the text of the page, so only they get it unescaped.
+	// Other kinds keep the markup of descriptions as the source escaped it.
+	if rule.Kind == RegexpRuleKind {
+		content = []byte(html.UnescapeString(string(content)))
+	}
+	posts, report, err := ParseContentWithReport(rule, content)
+	if report != nil {
+		info.ParseReport = *report
+	}
+	if err != nil {
+		return nil, info, errors.New("getting content error: " + err.Error())
+	}
+	resolvePostLinks(posts, DocumentBase(source, content, rule.Kind != FeedRuleKind && rule.Kind != JSONPathRuleKind), rule.StripTrackingParams)
+	return posts, info, nil
+}
+
+// RuleTestResult is what a rule found in the source during a dry run.
+type RuleTestResult struct {
+	Error string
+	DownloadInfo
+	ParseReport
+	Posts []Post
+}
+
+// DryRunRule downloads and parses the source the way a channel update does,
+// but saves nothing, so a rule can be checked before the channel is created.
+func DryRunRule(source string, rule *Rule, requestConfig *RequestConfig) *RuleTestResult {
+	result := &RuleTestResult{Posts: []Post{}}
+	err := requestConfig.Validate()
+	if err != nil {
+		result.Error = "bad request config: " + err.Error()
+		return result
+	}
+	compiledRule, err := CompileRule(rule)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	posts, info, err := GetContentWithInfo(source, compiledRule, CacheValidators{}, requestConfig)
+	if info != nil {
+		result.DownloadInfo = info.DownloadInfo
+		result.ParseReport = info.ParseReport
+	}
 	if err != nil {
-		return nil, errors.New("getting content error: " + err.Error())
+		result.Error = err.Error()
+		return result
 	}
-	return posts, nil
+	result.Posts = append(result.Posts, posts...)
+	return result
 }
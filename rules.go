@@ -2,17 +2,228 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"github.com/antchfx/xpath"
+	"github.com/oliveagle/jsonpath"
+	"reflect"
 	"regexp"
+	"strings"
+	"time"
 )
 
+const (
+	RegexpRuleKind   = "regexp"
+	FeedRuleKind     = "feed"
+	SelectorRuleKind = "selector"
+	JSONPathRuleKind = "jsonpath"
+	XPathRuleKind    = "xpath"
+)
+
+var dateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
 type CompiledRule struct {
-	TitlePattern       regexp.Regexp
-	ItemPattern        regexp.Regexp
-	LinkPattern        regexp.Regexp
-	DescriptionPattern regexp.Regexp
+	Kind                string
+	DateLayout          string
+	StripTrackingParams bool
+	OptionalTitle       bool
+	OptionalDescription bool
+	MaxBadItemsShare    float64
+	OptionalPatterns    []string
+	TitlePattern        regexp.Regexp
+	ItemPattern         regexp.Regexp
+	LinkPattern         regexp.Regexp
+	DescriptionPattern  regexp.Regexp
+	DatePattern         *regexp.Regexp
+	AuthorPattern       *regexp.Regexp
+	GUIDPattern         *regexp.Regexp
+	ImagePattern        *regexp.Regexp
+
+	ItemSelector        CompiledSelector
+	TitleSelector       CompiledSelector
+	LinkSelector        CompiledSelector
+	DescriptionSelector CompiledSelector
+	DateSelector        *CompiledSelector
+	AuthorSelector      *CompiledSelector
+	GUIDSelector        *CompiledSelector
+	ImageSelector       *CompiledSelector
+
+	ItemPath        *jsonpath.Compiled
+	TitlePath       *jsonpath.Compiled
+	LinkPath        *jsonpath.Compiled
+	DescriptionPath *jsonpath.Compiled
+	DatePath        *jsonpath.Compiled
+	AuthorPath      *jsonpath.Compiled
+	GUIDPath        *jsonpath.Compiled
+	ImagePath       *jsonpath.Compiled
+
+	ItemXPath        *xpath.Expr
+	TitleXPath       *xpath.Expr
+	LinkXPath        *xpath.Expr
+	DescriptionXPath *xpath.Expr
+	DateXPath        *xpath.Expr
+	AuthorXPath      *xpath.Expr
+	GUIDXPath        *xpath.Expr
+	ImageXPath       *xpath.Expr
+}
+
+// ParseDate parses a captured publication date with the rule date layout,
+// falling back to the common feed formats when the layout is not set.
+func (rule *CompiledRule) ParseDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if rule.DateLayout != "" {
+		date, err := time.Parse(rule.DateLayout, value)
+		if err != nil {
+			return nil, errors.New("date parsing error: " + err.Error())
+		}
+		return &date, nil
+	}
+	for _, layout := range dateLayouts {
+		date, err := time.Parse(layout, value)
+		if err == nil {
+			return &date, nil
+		}
+	}
+	return nil, errors.New("date parsing error: unknown date format '" + value + "'")
+}
+
+// RuleFieldChange is a rule field which differs between two versions.
+type RuleFieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// DiffRules compares the patterns and settings of two rules field by field.
+func DiffRules(oldRule, newRule *Rule) []RuleFieldChange {
+	var changes []RuleFieldChange
+	oldValue := reflect.ValueOf(*oldRule)
+	newValue := reflect.ValueOf(*newRule)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if field.Anonymous {
+			continue
+		}
+		oldField := fmt.Sprint(oldValue.Field(i).Interface())
+		newField := fmt.Sprint(newValue.Field(i).Interface())
+		if oldField != newField {
+			changes = append(changes, RuleFieldChange{Field: field.Name, Old: oldField, New: newField})
+		}
+	}
+	return changes
 }
 
 func CompileRule(rule *Rule) (*CompiledRule, error) {
+	var result *CompiledRule
+	var err error
+	switch rule.Kind {
+	case "", RegexpRuleKind:
+		result, err = compileRegexpRule(rule)
+	case FeedRuleKind:
+		result = &CompiledRule{Kind: FeedRuleKind}
+	case SelectorRuleKind:
+		result, err = compileSelectorRule(rule)
+	case JSONPathRuleKind:
+		result, err = compileJSONPathRule(rule)
+	case XPathRuleKind:
+		result, err = compileXPathRule(rule)
+	default:
+		return nil, errors.New("compilation rule error: unknown rule kind '" + rule.Kind + "'")
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.DateLayout = rule.DateLayout
+	result.StripTrackingParams = rule.StripTrackingParams
+	result.OptionalPatterns = optionalPatterns(rule)
+	err = compileTolerance(rule, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func compileTolerance(rule *Rule, result *CompiledRule) error {
+	if rule.MaxBadItemsShare < 0 || rule.MaxBadItemsShare > 1 {
+		return errors.New(fmt.Sprintf("compilation rule error: bad items share should be from 0 to 1, got %v", rule.MaxBadItemsShare))
+	}
+	result.MaxBadItemsShare = rule.MaxBadItemsShare
+	for _, field := range strings.Split(rule.OptionalFields, ",") {
+		switch strings.ToLower(strings.TrimSpace(field)) {
+		case "":
+		case "title":
+			result.OptionalTitle = true
+		case "description":
+			result.OptionalDescription = true
+		default:
+			return errors.New("compilation rule error: field '" + field + "' can not be optional, only title and description can")
+		}
+	}
+	return nil
+}
+
+// optionalPatterns lists the names of the optional patterns the rule sets.
+func optionalPatterns(rule *Rule) []string {
+	var names []string
+	patterns := []struct{ name, pattern string }{
+		{"date", rule.DatePattern},
+		{"author", rule.AuthorPattern},
+		{"guid", rule.GUIDPattern},
+		{"image", rule.ImagePattern},
+	}
+	for _, pattern := range patterns {
+		if pattern.pattern != "" {
+			names = append(names, pattern.name)
+		}
+	}
+	return names
+}
+
+func compileOptionalRegexp(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+func compileOptionalSelector(pattern string) (*CompiledSelector, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return CompileSelector(pattern)
+}
+
+func compileOptionalXPath(expr string) (*xpath.Expr, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return xpath.Compile(expr)
+}
+
+func compileRegexpRule(rule *Rule) (*CompiledRule, error) {
+	requiredPatterns := []struct{ name, pattern string }{
+		{"item", rule.ItemPattern},
+		{"title", rule.TitlePattern},
+		{"link", rule.LinkPattern},
+	}
+	for _, required := range requiredPatterns {
+		if strings.TrimSpace(required.pattern) == "" {
+			return nil, errors.New("compilation rule error: empty " + required.name + " regexp")
+		}
+	}
 	compiledItemPattern, err := regexp.Compile(rule.ItemPattern)
 	if err != nil {
 		return nil, errors.New("compilation rule error: " + err.Error())
@@ -29,11 +240,189 @@ func CompileRule(rule *Rule) (*CompiledRule, error) {
 	if err != nil {
 		return nil, errors.New("compilation rule error: " + err.Error())
 	}
+	compiledDatePattern, err := compileOptionalRegexp(rule.DatePattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	compiledAuthorPattern, err := compileOptionalRegexp(rule.AuthorPattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	compiledGUIDPattern, err := compileOptionalRegexp(rule.GUIDPattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	compiledImagePattern, err := compileOptionalRegexp(rule.ImagePattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
 	result := CompiledRule{
+		Kind:               RegexpRuleKind,
 		TitlePattern:       *compiledTitlePattern,
 		DescriptionPattern: *compiledDescriptionPattern,
 		ItemPattern:        *compiledItemPattern,
 		LinkPattern:        *compiledLinkPattern,
+		DatePattern:        compiledDatePattern,
+		AuthorPattern:      compiledAuthorPattern,
+		GUIDPattern:        compiledGUIDPattern,
+		ImagePattern:       compiledImagePattern,
+	}
+	return &result, nil
+}
+
+func compileSelectorRule(rule *Rule) (*CompiledRule, error) {
+	itemSelector, err := CompileSelector(rule.ItemPattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	if itemSelector.Attribute != "" {
+		return nil, errors.New("compilation rule error: item selector can not extract an attribute")
+	}
+	if itemSelector.Selector == nil {
+		return nil, errors.New("compilation rule error: empty item selector")
+	}
+	titleSelector, err := CompileSelector(rule.TitlePattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	linkSelector, err := CompileSelector(rule.LinkPattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	descriptionSelector, err := CompileSelector(rule.DescriptionPattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	dateSelector, err := compileOptionalSelector(rule.DatePattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	authorSelector, err := compileOptionalSelector(rule.AuthorPattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	guidSelector, err := compileOptionalSelector(rule.GUIDPattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	imageSelector, err := compileOptionalSelector(rule.ImagePattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	result := CompiledRule{
+		Kind:                SelectorRuleKind,
+		ItemSelector:        *itemSelector,
+		TitleSelector:       *titleSelector,
+		LinkSelector:        *linkSelector,
+		DescriptionSelector: *descriptionSelector,
+		DateSelector:        dateSelector,
+		AuthorSelector:      authorSelector,
+		GUIDSelector:        guidSelector,
+		ImageSelector:       imageSelector,
+	}
+	return &result, nil
+}
+
+func compileJSONPath(name, path string, isOptional bool) (*jsonpath.Compiled, error) {
+	if strings.TrimSpace(path) == "" {
+		if isOptional {
+			return nil, nil
+		}
+		return nil, errors.New("empty " + name + " jsonpath")
+	}
+	return jsonpath.Compile(path)
+}
+
+func compileJSONPathRule(rule *Rule) (*CompiledRule, error) {
+	itemPath, err := compileJSONPath("item", rule.ItemPattern, false)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	titlePath, err := compileJSONPath("title", rule.TitlePattern, false)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	linkPath, err := compileJSONPath("link", rule.LinkPattern, false)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	descriptionPath, err := compileJSONPath("description", rule.DescriptionPattern, true)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	datePath, err := compileJSONPath("date", rule.DatePattern, true)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	authorPath, err := compileJSONPath("author", rule.AuthorPattern, true)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	guidPath, err := compileJSONPath("guid", rule.GUIDPattern, true)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	imagePath, err := compileJSONPath("image", rule.ImagePattern, true)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	result := CompiledRule{
+		Kind:            JSONPathRuleKind,
+		ItemPath:        itemPath,
+		TitlePath:       titlePath,
+		LinkPath:        linkPath,
+		DescriptionPath: descriptionPath,
+		DatePath:        datePath,
+		AuthorPath:      authorPath,
+		GUIDPath:        guidPath,
+		ImagePath:       imagePath,
+	}
+	return &result, nil
+}
+
+func compileXPathRule(rule *Rule) (*CompiledRule, error) {
+	itemXPath, err := xpath.Compile(rule.ItemPattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	titleXPath, err := xpath.Compile(rule.TitlePattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	linkXPath, err := xpath.Compile(rule.LinkPattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	descriptionXPath, err := xpath.Compile(rule.DescriptionPattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	dateXPath, err := compileOptionalXPath(rule.DatePattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	authorXPath, err := compileOptionalXPath(rule.AuthorPattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	guidXPath, err := compileOptionalXPath(rule.GUIDPattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	imageXPath, err := compileOptionalXPath(rule.ImagePattern)
+	if err != nil {
+		return nil, errors.New("compilation rule error: " + err.Error())
+	}
+	result := CompiledRule{
+		Kind:             XPathRuleKind,
+		ItemXPath:        itemXPath,
+		TitleXPath:       titleXPath,
+		LinkXPath:        linkXPath,
+		DescriptionXPath: descriptionXPath,
+		DateXPath:        dateXPath,
+		AuthorXPath:      authorXPath,
+		GUIDXPath:        guidXPath,
+		ImageXPath:       imageXPath,
 	}
 	return &result, nil
 }
@@ -10,16 +10,19 @@ name = "Habr"
 source = "http://habr.com"
 
 data = {
-    "channel_name": name,
-    "channel_source": source,
-    "item_pattern": item,
-    "title_pattern": title,
-    "description_pattern": description,
-    "link_pattern": link,
+    "Name": name,
+    "Source": source,
+    "Rule": {
+        "ItemPattern": item,
+        "TitlePattern": title,
+        "DescriptionPattern": description,
+        "LinkPattern": link,
+    },
 }
 
-r = requests.post("http://0.0.0.0:8080/addchannel", data=data)
-
-r.raise_for_status()
-print("Success")
+r = requests.post("http://0.0.0.0:8080/api/v1/channels", json=data)
 
+if r.status_code != requests.codes.created:
+    print("Error: " + r.json()["Error"]["Message"])
+    exit(1)
+print("Success, channel ID=%d" % r.json()["ID"])
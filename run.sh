@@ -1,3 +1,3 @@
 #!/bin/sh
-go run channels_updater.go configer.go database.go main.go parser.go rules.go templater.go
+go run api.go channels_updater.go charset.go configer.go database.go feed_parser.go fetcher.go jsonpath_parser.go links.go main.go parser.go rules.go selector_parser.go templater.go xpath_parser.go
 
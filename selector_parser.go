@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"regexp"
+	"strings"
+)
+
+var attributeSuffixPattern = regexp.MustCompile(`@([A-Za-z_:][-\w:.]*)?$`)
+
+type CompiledSelector struct {
+	Selector  cascadia.Selector
+	Attribute string
+}
+
+// attributeSuffixIndex returns the position of the trailing "@attr" of the pattern
+// or -1, if there is none. An "@" inside brackets or quotes belongs to the selector.
+func attributeSuffixIndex(pattern string) int {
+	location := attributeSuffixPattern.FindStringIndex(pattern)
+	if location == nil {
+		return -1
+	}
+	var quote rune
+	depth := 0
+	for _, char := range pattern[:location[0]] {
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '"' || char == '\'':
+			quote = char
+		case char == '[' || char == '(':
+			depth++
+		case char == ']' || char == ')':
+			depth--
+		}
+	}
+	if quote != 0 || depth > 0 {
+		return -1
+	}
+	return location[0]
+}
+
+// CompileSelector compiles patterns like "a.title" or "a.title@href".
+// An empty selector part, e.g. "@href", refers to the item element itself.
+func CompileSelector(pattern string) (*CompiledSelector, error) {
+	pattern = strings.TrimSpace(pattern)
+	var attribute string
+	if index := attributeSuffixIndex(pattern); index != -1 {
+		attribute = pattern[index+1:]
+		pattern = strings.TrimSpace(pattern[:index])
+		if attribute == "" {
+			return nil, errors.New("empty attribute name in selector '" + pattern + "@'")
+		}
+	}
+	if pattern == "" {
+		return &CompiledSelector{Attribute: attribute}, nil
+	}
+	selector, err := cascadia.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &CompiledSelector{Selector: selector, Attribute: attribute}, nil
+}
+
+func getContentBySelector(name string, item *goquery.Selection, selector *CompiledSelector, asHtml bool) (string, error) {
+	selection := item
+	if selector.Selector != nil {
+		selection = item.FindMatcher(selector.Selector).First()
+	}
+	if selection.Length() == 0 {
+		return "", errors.New(fmt.Sprintf("can not find %v by selector", name))
+	}
+	if selector.Attribute != "" {
+		value, ok := selection.Attr(selector.Attribute)
+		if !ok {
+			return "", errors.New(fmt.Sprintf("can not find %v attribute '%v' by selector", name, selector.Attribute))
+		}
+		return strings.TrimSpace(value), nil
+	}
+	if asHtml {
+		value, err := selection.Html()
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("can not render %v: %v", name, err.Error()))
+		}
+		return strings.TrimSpace(value), nil
+	}
+	return strings.TrimSpace(selection.Text()), nil
+}
+
+func getOptionalContentBySelector(name string, item *goquery.Selection, selector *CompiledSelector) string {
+	if selector == nil {
+		return ""
+	}
+	value, err := getContentBySelector(name, item, selector, false)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+func parseSelectorContent(rule *CompiledRule, content []byte) ([]Post, *ParseReport, error) {
+	document, err := goquery.NewDocumentFromReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, nil, errors.New("html parsing error: " + err.Error())
+	}
+
+	items := document.FindMatcher(rule.ItemSelector.Selector)
+	if items.Length() == 0 {
+		return nil, nil, errors.New("can not find item by selector")
+	}
+
+	return collectItems(rule, items.Length(), func(i int) *itemFields {
+		item := items.Eq(i)
+
+		var fields itemFields
+		fields.Title, fields.TitleErr = getContentBySelector("title", item, &rule.TitleSelector, false)
+		fields.Link, fields.LinkErr = getContentBySelector("link", item, &rule.LinkSelector, false)
+		fields.Description, fields.DescriptionErr = getContentBySelector("description", item, &rule.DescriptionSelector, true)
+		fields.Meta = postMeta{
+			Date:   getOptionalContentBySelector("date", item, rule.DateSelector),
+			Author: getOptionalContentBySelector("author", item, rule.AuthorSelector),
+			GUID:   getOptionalContentBySelector("guid", item, rule.GUIDSelector),
+			Image:  getOptionalContentBySelector("image", item, rule.ImageSelector),
+		}
+		return &fields
+	})
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/text/encoding/charmap"
 	"html"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
@@ -62,14 +68,7 @@ func getExpectedPosts(filename string) ([]Post, error) {
 }
 
 func addHabrChannel(api *DBApi, mockedSource string) (*Channel, error) {
-	habrChannel, err := dbApi.CreateChannel(
-		"Habr",
-		mockedSource,
-		habrRule.ItemPattern,
-		habrRule.LinkPattern,
-		habrRule.TitlePattern,
-		habrRule.DescriptionPattern,
-	)
+	habrChannel, err := dbApi.CreateChannel(Channel{Name: "Habr", Source: mockedSource, Rule: habrRule})
 	if err != nil {
 		return nil, errors.New("can not create habr channel: " + err.Error())
 	}
@@ -87,14 +86,7 @@ var upRule = Rule{
 var compiledUpRule, _ = CompileRule(&upRule)
 
 func addUbuntuPlanetChannel(api *DBApi, mockedSource string) (*Channel, error) {
-	upChannel, err := dbApi.CreateChannel(
-		"Ubuntu Planet",
-		mockedSource,
-		upRule.ItemPattern,
-		upRule.LinkPattern,
-		upRule.TitlePattern,
-		upRule.DescriptionPattern,
-	)
+	upChannel, err := dbApi.CreateChannel(Channel{Name: "Ubuntu Planet", Source: mockedSource, Rule: upRule})
 	if err != nil {
 		return nil, errors.New("can not create ubuntu planet channel: " + err.Error())
 	}
@@ -157,11 +149,28 @@ func TestServerDatabase(t *testing.T) {
 			dbApi.db.Find(&channels)
 			So(len(channels), ShouldEqual, 1)
 			channel := channels[0]
-			dbApi.MarkChannelAsBroken(channel.ID)
+			err := dbApi.UpdateChannelHealth(channel.ID, channel.Revision, ChannelHealth{Health: ChannelBroken, ConsecutiveFailures: 5})
+			So(err, ShouldBeNil)
 			dbApi.db.Find(&channels)
 			So(len(channels), ShouldEqual, 1)
 			channel = channels[0]
 			So(channel.IsBroken, ShouldEqual, true)
+			So(channel.Health, ShouldEqual, ChannelBroken)
+		})
+
+		Convey("Test restoring channel health", func() {
+			var channels []Channel
+			dbApi.db.Find(&channels)
+			So(len(channels), ShouldEqual, 1)
+			channel := channels[0]
+			So(dbApi.UpdateChannelHealth(channel.ID, channel.Revision, ChannelHealth{Health: ChannelBroken}), ShouldBeNil)
+			err := dbApi.UpdateChannelHealth(channel.ID, channel.Revision, ChannelHealth{Health: ChannelDegraded, ConsecutiveSuccesses: 1})
+			So(err, ShouldBeNil)
+			dbApi.db.Find(&channels)
+			channel = channels[0]
+			So(channel.IsBroken, ShouldBeFalse)
+			So(channel.Health, ShouldEqual, ChannelDegraded)
+			So(channel.ConsecutiveSuccesses, ShouldEqual, 1)
 		})
 
 		Convey("Test deleting channel", func() {
@@ -197,13 +206,9 @@ func TestServerDatabase(t *testing.T) {
 		})
 
 		Convey("Test creating rule", func() {
-			rule, err := dbApi.CreateRule(
-				habrRule.ItemPattern,
-				habrRule.LinkPattern,
-				habrRule.TitlePattern,
-				habrRule.DescriptionPattern,
-			)
+			rule, err := dbApi.CreateRule(habrRule)
 			So(err, ShouldBeNil)
+			So(rule.Kind, ShouldEqual, RegexpRuleKind)
 			So(rule.ItemPattern, ShouldEqual, habrRule.ItemPattern)
 			So(rule.TitlePattern, ShouldEqual, habrRule.TitlePattern)
 			So(rule.LinkPattern, ShouldEqual, habrRule.LinkPattern)
@@ -286,12 +291,20 @@ func TestServerDatabase(t *testing.T) {
 			upChannel, err := addUbuntuPlanetChannel(&dbApi, upTs.URL)
 			So(err, ShouldBeNil)
 
-			err = dbApi.FetchChannelContent(habrChannel)
+			_, err = dbApi.FetchChannelContent(habrChannel)
 			So(err, ShouldBeNil)
 
-			err = dbApi.FetchChannelContent(upChannel)
+			_, err = dbApi.FetchChannelContent(upChannel)
 			So(err, ShouldBeNil)
 
+			history := dbApi.GetFetchHistory(habrChannel.ID)
+			So(len(history), ShouldEqual, 1)
+			So(history[0].StatusCode, ShouldEqual, http.StatusOK)
+			So(history[0].BytesCount, ShouldBeGreaterThan, 0)
+			So(history[0].ParsedCount, ShouldEqual, 20)
+			So(history[0].NewCount, ShouldEqual, 20)
+			So(history[0].Error, ShouldEqual, "")
+
 			expectedHabrPosts, err := getExpectedPosts("tests/data/habr.com_posts")
 			So(err, ShouldBeNil)
 
@@ -304,6 +317,7 @@ func TestServerDatabase(t *testing.T) {
 				actualHabrPost.UpdatedAt = time.Time{}
 				actualHabrPost.ID = 0
 				actualHabrPost.ChannelID = 0
+				actualHabrPost.Identity = ""
 				So(expectedHabrPosts, ShouldContain, actualHabrPost)
 			}
 
@@ -319,10 +333,407 @@ func TestServerDatabase(t *testing.T) {
 				actualUpPost.UpdatedAt = time.Time{}
 				actualUpPost.ID = 0
 				actualUpPost.ChannelID = 0
+				actualUpPost.Identity = ""
+				So(actualUpPost.PublishedAt, ShouldNotBeNil)
+				publishedAt := actualUpPost.PublishedAt.UTC()
+				actualUpPost.PublishedAt = &publishedAt
 				So(expectedUpPosts, ShouldContain, actualUpPost)
 			}
 		})
 
+		Convey("Test refetching channel content keeps existing posts", func() {
+			var habrChannel Channel
+			dbApi.db.Preload("Rule").Where("Name = ?", "Habr").First(&habrChannel)
+			postsBefore := dbApi.GetChannelContent(habrChannel.ID)
+			So(len(postsBefore), ShouldBeGreaterThan, 0)
+
+			archivedPost := Post{Title: "Archived", Link: "http://example.com/archived"}
+			createdCount, err := dbApi.UpsertChannelPosts(habrChannel.ID, []Post{archivedPost})
+			So(err, ShouldBeNil)
+			So(createdCount, ShouldEqual, 1)
+
+			stats, err := dbApi.UpdateChannelContent(habrChannel.ID)
+			So(err, ShouldBeNil)
+			So(stats.ParsedCount, ShouldEqual, len(postsBefore))
+			So(stats.NewCount, ShouldEqual, 0)
+
+			postsAfter := dbApi.GetChannelContent(habrChannel.ID)
+			So(len(postsAfter), ShouldEqual, len(postsBefore)+1)
+
+			var archivedPosts []Post
+			dbApi.db.Where("channel_id = ? AND title = ?", habrChannel.ID, "Archived").Find(&archivedPosts)
+			So(len(archivedPosts), ShouldEqual, 1)
+
+			createdCount, err = dbApi.UpsertChannelPosts(habrChannel.ID, []Post{{Title: "Archived again", Link: "HTTP://EXAMPLE.COM/archived/#top"}})
+			So(err, ShouldBeNil)
+			So(createdCount, ShouldEqual, 0)
+		})
+
+		Convey("Test resolving links of stored posts", func() {
+			channel, err := dbApi.CreateChannel(Channel{Name: "Relative links", Source: "http://example.com/blog/", Rule: Rule{Kind: FeedRuleKind}})
+			So(err, ShouldBeNil)
+			dbApi.db.Create(&Post{ChannelID: channel.ID, Title: "Relative", Link: "posts/1?utm_source=feed", Image: "/1.png", Identity: "link:posts/1?utm_source=feed"})
+
+			dbApi.resolveStoredPostLinks()
+
+			var post Post
+			dbApi.db.Where("channel_id = ? AND title = ?", channel.ID, "Relative").First(&post)
+			So(post.Link, ShouldEqual, "http://example.com/blog/posts/1?utm_source=feed")
+			So(post.Image, ShouldEqual, "http://example.com/1.png")
+			So(post.Identity, ShouldEqual, "link:http://example.com/blog/posts/1?utm_source=feed")
+
+			createdCount, err := dbApi.UpsertChannelPosts(channel.ID, []Post{{Title: "Relative", Link: "http://example.com/blog/posts/1?utm_source=feed"}})
+			So(err, ShouldBeNil)
+			So(createdCount, ShouldEqual, 0)
+			So(dbApi.DeleteChannel(channel.ID), ShouldBeNil)
+		})
+
+		Convey("Test refetching not modified channel content", func() {
+			requestsCount := 0
+			cachedTs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requestsCount++
+				if r.Header.Get("If-None-Match") == "\"habr\"" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				data, err := ioutil.ReadFile("tests/data/habr.com_response")
+				if err != nil {
+					panic("Can not create a test server" + err.Error())
+				}
+				w.Header().Set("ETag", "\"habr\"")
+				w.Write(data)
+			}))
+			defer cachedTs.Close()
+			habrChannel, err := addHabrChannel(&dbApi, cachedTs.URL)
+			So(err, ShouldBeNil)
+
+			stats, err := dbApi.UpdateChannelContent(habrChannel.ID)
+			So(err, ShouldBeNil)
+			So(stats.NewCount, ShouldEqual, 20)
+			channel, err := dbApi.GetChannelById(habrChannel.ID)
+			So(err, ShouldBeNil)
+			So(channel.ETag, ShouldEqual, "\"habr\"")
+
+			stats, err = dbApi.UpdateChannelContent(habrChannel.ID)
+			So(err, ShouldBeNil)
+			So(stats.ParsedCount, ShouldEqual, 0)
+			So(stats.NewCount, ShouldEqual, 0)
+			So(requestsCount, ShouldEqual, 2)
+			So(len(dbApi.GetChannelContent(habrChannel.ID)), ShouldEqual, 20)
+			So(dbApi.GetFetchHistory(habrChannel.ID)[0].StatusCode, ShouldEqual, http.StatusNotModified)
+			So(dbApi.DeleteChannel(habrChannel.ID), ShouldBeNil)
+		})
+
+		Convey("Test keeping request config out of channel listing", func() {
+			channel, err := dbApi.CreateChannel(Channel{
+				Name:          "Private wiki",
+				Source:        upTs.URL,
+				Rule:          Rule{Kind: FeedRuleKind},
+				RequestConfig: RequestConfig{Headers: "Authorization: Bearer token"},
+			})
+			So(err, ShouldBeNil)
+			So(channel.RequestConfig, ShouldResemble, RequestConfig{})
+
+			for _, listedChannel := range dbApi.ListChannels() {
+				So(listedChannel.RequestConfig.Headers, ShouldEqual, "")
+			}
+			requestConfig, err := dbApi.GetChannelRequestConfig(channel.ID)
+			So(err, ShouldBeNil)
+			So(requestConfig.Headers, ShouldEqual, "Authorization: Bearer token")
+
+			_, err = dbApi.CreateChannel(Channel{Name: "Bad", Source: upTs.URL, Rule: Rule{Kind: FeedRuleKind},
+				RequestConfig: RequestConfig{Headers: "Authorization"}})
+			So(err, ShouldNotBeNil)
+			So(dbApi.DeleteChannel(channel.ID), ShouldBeNil)
+		})
+
+		Convey("Test updating channels", func() {
+			channel, err := dbApi.CreateChannel(Channel{Name: "Planet", Source: upTs.URL, Rule: upRule})
+			So(err, ShouldBeNil)
+			stats, err := dbApi.FetchChannelContent(channel)
+			So(err, ShouldBeNil)
+			So(stats.HadPosts, ShouldBeFalse)
+			stats, err = dbApi.FetchChannelContent(channel)
+			So(err, ShouldBeNil)
+			So(stats.HadPosts, ShouldBeTrue)
+			postsCount := len(dbApi.GetChannelContent(channel.ID))
+			So(postsCount, ShouldBeGreaterThan, 0)
+			dbApi.UpdateChannelValidators(channel.ID, channel.Revision, CacheValidators{ETag: "\"planet\""})
+
+			updatedChannel, err := dbApi.UpdateChannel(Channel{
+				Model:           gorm.Model{ID: channel.ID},
+				Name:            "Ubuntu Planet feed",
+				Source:          upTs.URL + "/rss20.xml",
+				Rule:            Rule{Kind: FeedRuleKind},
+				RefreshInterval: time.Hour,
+			}, nil, "editor")
+			So(err, ShouldBeNil)
+			So(updatedChannel.ID, ShouldEqual, channel.ID)
+			So(updatedChannel.RuleID, ShouldEqual, channel.RuleID)
+			So(updatedChannel.Name, ShouldEqual, "Ubuntu Planet feed")
+			So(updatedChannel.Rule.Kind, ShouldEqual, FeedRuleKind)
+			So(updatedChannel.Rule.ItemPattern, ShouldEqual, "")
+			So(updatedChannel.RefreshInterval, ShouldEqual, time.Hour)
+			So(updatedChannel.ETag, ShouldEqual, "")
+			So(updatedChannel.NextUpdateAt, ShouldBeNil)
+			So(len(dbApi.GetChannelContent(channel.ID)), ShouldEqual, postsCount)
+			So(updatedChannel.Revision, ShouldBeGreaterThan, channel.Revision)
+
+			So(dbApi.UpdateChannelValidators(channel.ID, channel.Revision, CacheValidators{ETag: "\"stale\""}), ShouldBeNil)
+			So(dbApi.ScheduleChannelUpdate(channel.ID, channel.Revision, time.Now().Add(time.Hour), 0), ShouldBeNil)
+			updatedChannel, err = dbApi.GetChannelById(channel.ID)
+			So(err, ShouldBeNil)
+			So(updatedChannel.ETag, ShouldEqual, "")
+			So(updatedChannel.NextUpdateAt, ShouldBeNil)
+
+			_, err = dbApi.UpdateChannel(Channel{Model: gorm.Model{ID: channel.ID}, Name: "Bad", Source: upTs.URL,
+				Rule: Rule{ItemPattern: "("}}, nil, "")
+			So(err, ShouldHaveSameTypeAs, &ValidationError{})
+			_, err = dbApi.UpdateChannel(Channel{Model: gorm.Model{ID: channel.ID + 1000}, Name: "Missing", Source: upTs.URL,
+				Rule: Rule{Kind: FeedRuleKind}}, nil, "")
+			So(err, ShouldHaveSameTypeAs, &NotFoundError{})
+
+			So(dbApi.UpdateChannelRequestConfig(channel.ID, RequestConfig{Cookies: "session=abc"}), ShouldBeNil)
+			requestConfig, err := dbApi.GetChannelRequestConfig(channel.ID)
+			So(err, ShouldBeNil)
+			So(requestConfig.Cookies, ShouldEqual, "session=abc")
+			So(dbApi.UpdateChannelRequestConfig(channel.ID, RequestConfig{Password: "secret"}), ShouldHaveSameTypeAs, &ValidationError{})
+			_, err = dbApi.UpdateChannel(Channel{Model: gorm.Model{ID: channel.ID}, Name: "Not saved", Source: upTs.URL,
+				Rule: Rule{Kind: FeedRuleKind}}, &RequestConfig{Password: "secret"}, "")
+			So(err, ShouldHaveSameTypeAs, &ValidationError{})
+			updatedChannel, err = dbApi.GetChannelById(channel.ID)
+			So(err, ShouldBeNil)
+			So(updatedChannel.Name, ShouldEqual, "Ubuntu Planet feed")
+
+			dbApi.RemoveChannelContent(channel)
+			So(dbApi.DeleteChannel(channel.ID), ShouldBeNil)
+			So(dbApi.DeleteChannel(channel.ID), ShouldHaveSameTypeAs, &NotFoundError{})
+		})
+
+		Convey("Test selecting due channels in the database", func() {
+			channel, err := dbApi.CreateChannel(Channel{Name: "Scheduled", Source: upTs.URL, Rule: upRule})
+			So(err, ShouldBeNil)
+			isDue := func() bool {
+				for _, dueChannel := range dbApi.ListDueChannels(time.Now()) {
+					if dueChannel.ID == channel.ID {
+						So(dueChannel.Rule.ID, ShouldEqual, 0)
+						return true
+					}
+				}
+				return false
+			}
+			So(isDue(), ShouldBeTrue)
+
+			updateAt := time.Now().Add(time.Minute)
+			So(dbApi.ScheduleChannelUpdate(channel.ID, channel.Revision, updateAt, 0), ShouldBeNil)
+			So(isDue(), ShouldBeFalse)
+			nextUpdateAt := dbApi.NextChannelUpdateAt(time.Now())
+			So(nextUpdateAt, ShouldNotBeNil)
+			So(nextUpdateAt.After(updateAt), ShouldBeFalse)
+
+			So(dbApi.ScheduleChannelUpdate(channel.ID, channel.Revision, time.Now().Add(-time.Minute), 0), ShouldBeNil)
+			So(isDue(), ShouldBeTrue)
+			So(dbApi.DeleteChannel(channel.ID), ShouldBeNil)
+		})
+
+		Convey("Test keeping rule history", func() {
+			channel, err := dbApi.CreateChannel(Channel{Name: "Versioned", Source: upTs.URL, Rule: upRule})
+			So(err, ShouldBeNil)
+			So(len(dbApi.GetRuleHistory(channel.RuleID)), ShouldEqual, 0)
+
+			editedRule := upRule
+			editedRule.TitlePattern = "<title>(.+?)</title>"
+			_, err = dbApi.UpdateChannel(Channel{Model: channel.Model, Name: channel.Name, Source: channel.Source, Rule: editedRule}, nil, "alice")
+			So(err, ShouldBeNil)
+			_, err = dbApi.UpdateChannel(Channel{Model: channel.Model, Name: "Renamed", Source: channel.Source, Rule: editedRule}, nil, "bob")
+			So(err, ShouldBeNil)
+
+			history := dbApi.GetRuleHistory(channel.RuleID)
+			So(len(history), ShouldEqual, 2)
+			So(history[0].Author, ShouldEqual, "alice")
+			So(history[1].Author, ShouldEqual, "")
+			entries, err := ruleHistory(history)
+			So(err, ShouldBeNil)
+			So(entries[0].Number, ShouldEqual, 2)
+			So(entries[0].Changes, ShouldResemble, []RuleFieldChange{
+				{Field: "TitlePattern", Old: upRule.TitlePattern, New: editedRule.TitlePattern},
+			})
+
+			channel, err = dbApi.GetChannelById(channel.ID)
+			So(err, ShouldBeNil)
+			So(dbApi.UpdateChannelValidators(channel.ID, channel.Revision, CacheValidators{ETag: "\"versioned\""}), ShouldBeNil)
+			channel, err = dbApi.GetChannelById(channel.ID)
+			So(err, ShouldBeNil)
+			So(channel.ETag, ShouldEqual, "\"versioned\"")
+			rule, err := dbApi.RollbackRule(channel.RuleID, history[1].ID, "carol")
+			So(err, ShouldBeNil)
+			So(rule.TitlePattern, ShouldEqual, upRule.TitlePattern)
+			updatedChannel, err := dbApi.GetChannelById(channel.ID)
+			So(err, ShouldBeNil)
+			So(updatedChannel.Rule.TitlePattern, ShouldEqual, upRule.TitlePattern)
+			So(updatedChannel.ETag, ShouldEqual, "")
+
+			history = dbApi.GetRuleHistory(channel.RuleID)
+			So(len(history), ShouldEqual, 3)
+			So(history[0].Author, ShouldEqual, "carol")
+			So(history[0].RestoredFrom, ShouldEqual, history[2].ID)
+
+			_, err = dbApi.RollbackRule(channel.RuleID, history[0].ID+1000, "carol")
+			So(err, ShouldHaveSameTypeAs, &NotFoundError{})
+			So(dbApi.DeleteChannel(channel.ID), ShouldBeNil)
+		})
+
+		Convey("Test sharing rule templates", func() {
+			templateRule := upRule
+			templateRule.Name = " Shared planet rule "
+			template, err := dbApi.CreateRule(templateRule)
+			So(err, ShouldBeNil)
+			So(template.Name, ShouldEqual, "Shared planet rule")
+			_, err = dbApi.CreateRule(templateRule)
+			So(err, ShouldHaveSameTypeAs, &ValidationError{})
+
+			first, err := dbApi.CreateChannel(Channel{Name: "Shared first", Source: upTs.URL, RuleID: template.ID})
+			So(err, ShouldBeNil)
+			second, err := dbApi.CreateChannel(Channel{Name: "Shared second", Source: upTs.URL, RuleID: template.ID})
+			So(err, ShouldBeNil)
+			So(second.RuleID, ShouldEqual, first.RuleID)
+			var templateChannels int
+			for _, ruleTemplate := range dbApi.ListRuleTemplates() {
+				if ruleTemplate.ID == template.ID {
+					templateChannels = ruleTemplate.ChannelsCount
+				}
+			}
+			So(templateChannels, ShouldEqual, 2)
+
+			editedRule := *template
+			editedRule.TitlePattern = "<title>(.+?)</title>"
+			_, err = dbApi.UpdateRule(editedRule, "alice")
+			So(err, ShouldBeNil)
+			for _, channel := range []*Channel{first, second} {
+				updatedChannel, err := dbApi.GetChannelById(channel.ID)
+				So(err, ShouldBeNil)
+				So(updatedChannel.Rule.TitlePattern, ShouldEqual, editedRule.TitlePattern)
+			}
+
+			detachedChannel, err := dbApi.UpdateChannel(Channel{Model: second.Model, Name: second.Name, Source: second.Source, Rule: editedRule}, nil, "bob")
+			So(err, ShouldBeNil)
+			So(detachedChannel.RuleID, ShouldNotEqual, template.ID)
+			So(detachedChannel.Rule.Name, ShouldEqual, "")
+
+			_, err = dbApi.UpdateChannel(Channel{Model: second.Model, Name: second.Name, Source: second.Source, RuleID: detachedChannel.RuleID + 1000}, nil, "bob")
+			So(err, ShouldHaveSameTypeAs, &ValidationError{})
+			switchedChannel, err := dbApi.UpdateChannel(Channel{Model: second.Model, Name: second.Name, Source: second.Source, RuleID: template.ID}, nil, "bob")
+			So(err, ShouldBeNil)
+			So(switchedChannel.RuleID, ShouldEqual, template.ID)
+			keptChannel, err := dbApi.UpdateChannel(Channel{Model: second.Model, Name: second.Name, Source: second.Source, RuleID: template.ID}, nil, "bob")
+			So(err, ShouldBeNil)
+			So(keptChannel.RuleID, ShouldEqual, template.ID)
+			So(keptChannel.Rule.Name, ShouldEqual, template.Name)
+			So(keptChannel.Rule.TitlePattern, ShouldEqual, editedRule.TitlePattern)
+
+			renamedRule := editedRule
+			renamedRule.Name = "Renamed planet rule"
+			_, err = dbApi.UpdateRule(renamedRule, "alice")
+			So(err, ShouldBeNil)
+			history := dbApi.GetRuleHistory(template.ID)
+			rolledBackRule, err := dbApi.RollbackRule(template.ID, history[len(history)-1].ID, "carol")
+			So(err, ShouldBeNil)
+			So(rolledBackRule.TitlePattern, ShouldEqual, upRule.TitlePattern)
+			So(rolledBackRule.Name, ShouldEqual, "Renamed planet rule")
+			_, err = dbApi.GetRuleTemplate(template.ID)
+			So(err, ShouldBeNil)
+
+			So(dbApi.DeleteChannel(first.ID), ShouldBeNil)
+			So(dbApi.DeleteChannel(second.ID), ShouldBeNil)
+			editedRule.Name = ""
+			_, err = dbApi.UpdateRule(editedRule, "alice")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Test querying posts page by page", func() {
+			channel, err := dbApi.CreateChannel(Channel{Name: "Paged", Source: upTs.URL, Rule: Rule{Kind: FeedRuleKind}})
+			So(err, ShouldBeNil)
+			var posts []Post
+			for i := 0; i < 5; i++ {
+				publishedAt := time.Date(2018, 11, 10+i, 0, 0, 0, 0, time.UTC)
+				posts = append(posts, Post{Title: fmt.Sprintf("Paged post %d", i), Link: fmt.Sprintf("http://example.com/paged/%d", i), PublishedAt: &publishedAt})
+			}
+			posts = append(posts, Post{Title: "Paged news without date", Link: "http://example.com/paged/undated"})
+			_, err = dbApi.UpsertChannelPosts(channel.ID, posts)
+			So(err, ShouldBeNil)
+
+			query := PostsQuery{ChannelID: channel.ID, Limit: 4}
+			firstPage, cursor, err := dbApi.QueryPosts(&query)
+			So(err, ShouldBeNil)
+			So(len(firstPage), ShouldEqual, 4)
+			So(firstPage[0].Title, ShouldEqual, "Paged news without date")
+			So(firstPage[1].Title, ShouldEqual, "Paged post 4")
+			So(cursor, ShouldNotBeNil)
+
+			decodedCursor, err := decodeCursor(encodeCursor(cursor))
+			So(err, ShouldBeNil)
+			query.After = decodedCursor
+			secondPage, cursor, err := dbApi.QueryPosts(&query)
+			So(err, ShouldBeNil)
+			So(cursor, ShouldBeNil)
+			So(len(secondPage), ShouldEqual, 2)
+			So(secondPage[0].Title, ShouldEqual, "Paged post 1")
+			So(secondPage[1].Title, ShouldEqual, "Paged post 0")
+
+			since := time.Date(2018, 11, 11, 0, 0, 0, 0, time.UTC)
+			until := time.Date(2018, 11, 13, 0, 0, 0, 0, time.UTC)
+			filtered, _, err := dbApi.QueryPosts(&PostsQuery{ChannelID: channel.ID, Title: "POST", Since: &since, Until: &until, Ascending: true, Limit: 10})
+			So(err, ShouldBeNil)
+			So(len(filtered), ShouldEqual, 2)
+			So(filtered[0].Title, ShouldEqual, "Paged post 1")
+			So(filtered[1].Title, ShouldEqual, "Paged post 2")
+
+			So(dbApi.DeleteChannel(channel.ID), ShouldBeNil)
+			allPosts, _, err := dbApi.QueryPosts(&PostsQuery{Title: "Paged", Limit: 10})
+			So(err, ShouldBeNil)
+			So(len(allPosts), ShouldEqual, 0)
+		})
+
+		Convey("Test recording failed fetch attempts", func() {
+			var habrChannel Channel
+			dbApi.db.Preload("Rule").Where("Name = ?", "Habr").First(&habrChannel)
+			historyBefore := dbApi.GetFetchHistory(habrChannel.ID)
+
+			brokenTs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("internal error"))
+			}))
+			defer brokenTs.Close()
+			habrChannel.Source = brokenTs.URL
+			_, err := dbApi.FetchChannelContent(&habrChannel)
+			So(err, ShouldNotBeNil)
+
+			history := dbApi.GetFetchHistory(habrChannel.ID)
+			So(len(history), ShouldEqual, len(historyBefore)+1)
+			So(history[0].StatusCode, ShouldEqual, http.StatusInternalServerError)
+			So(history[0].ParsedCount, ShouldEqual, 0)
+			So(history[0].Error, ShouldContainSubstring, "unexpected status 500")
+		})
+
+		Convey("Test upserting posts in batches", func() {
+			var upChannel Channel
+			dbApi.db.Where("Name = ?", "Ubuntu Planet").First(&upChannel)
+			postsBefore := dbApi.GetChannelContent(upChannel.ID)
+
+			var posts []Post
+			for i := 0; i < PostsInsertBatchSize+10; i++ {
+				posts = append(posts, Post{Title: fmt.Sprintf("Post %d", i), Link: fmt.Sprintf("http://example.com/batch/%d", i)})
+			}
+			createdCount, err := dbApi.UpsertChannelPosts(upChannel.ID, posts)
+			So(err, ShouldBeNil)
+			So(createdCount, ShouldEqual, len(posts))
+
+			postsAfter := dbApi.GetChannelContent(upChannel.ID)
+			So(len(postsAfter), ShouldEqual, len(postsBefore)+len(posts))
+
+			dbApi.db.Unscoped().Where("channel_id = ? AND link LIKE ?", upChannel.ID, "http://example.com/batch/%").Delete(Post{})
+		})
+
 		Convey("Test removing channel content", func() {
 			var habrChannel, upChannel Channel
 			dbApi.db.Where("Name = ?", "Habr").First(&habrChannel)
@@ -343,8 +754,1325 @@ func TestServerDatabase(t *testing.T) {
 				actualUpPost.UpdatedAt = time.Time{}
 				actualUpPost.ID = 0
 				actualUpPost.ChannelID = 0
+				actualUpPost.Identity = ""
+				So(actualUpPost.PublishedAt, ShouldNotBeNil)
+				publishedAt := actualUpPost.PublishedAt.UTC()
+				actualUpPost.PublishedAt = &publishedAt
 				So(expectedUpPosts, ShouldContain, actualUpPost)
 			}
 		})
 	})
 }
+
+func TestFeedParsing(t *testing.T) {
+	Convey("Test feed parsing", t, func() {
+		Convey("Test parsing RSS 2.0 feed", func() {
+			data, err := ioutil.ReadFile("tests/data/ubuntu_planet_response")
+			So(err, ShouldBeNil)
+
+			feedRule, err := CompileRule(&Rule{Kind: FeedRuleKind})
+			So(err, ShouldBeNil)
+
+			actualPosts, err := ParseContent(feedRule, data)
+			So(err, ShouldBeNil)
+
+			expectedPosts, err := getExpectedPosts("tests/data/ubuntu_planet_posts")
+			So(err, ShouldBeNil)
+			So(len(actualPosts), ShouldEqual, len(expectedPosts))
+
+			for i, actualPost := range actualPosts {
+				So(actualPost.Title, ShouldEqual, expectedPosts[i].Title)
+				So(actualPost.Link, ShouldEqual, expectedPosts[i].Link)
+				So(actualPost.Description, ShouldEqual, expectedPosts[i].Description)
+			}
+			So(actualPosts[0].GUID, ShouldEqual, "https://podcastubuntuportugal.org/?p=1041")
+			So(actualPosts[0].PublishedAt.Equal(time.Date(2018, 11, 18, 23, 32, 18, 0, time.UTC)), ShouldBeTrue)
+		})
+
+		Convey("Test parsing Atom feed", func() {
+			data := []byte(`<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+	<title>Example</title>
+	<entry>
+		<title type="html">Tom &amp;amp; Jerry</title>
+		<link rel="alternate" href="http://example.com/1"/>
+		<id>urn:uuid:1</id>
+		<published>2018-11-18T10:00:00Z</published>
+		<author><name>John</name></author>
+		<summary><![CDATA[<p>Summary</p>]]></summary>
+		<link rel="enclosure" type="image/png" href="http://example.com/1.png"/>
+	</entry>
+</feed>`)
+
+			actualPosts, err := ParseFeed(data)
+			So(err, ShouldBeNil)
+			So(len(actualPosts), ShouldEqual, 1)
+
+			post := actualPosts[0]
+			So(post.Title, ShouldEqual, "Tom &amp; Jerry")
+			So(post.Link, ShouldEqual, "http://example.com/1")
+			So(post.GUID, ShouldEqual, "urn:uuid:1")
+			So(post.Author, ShouldEqual, "John")
+			So(post.Description, ShouldEqual, "<p>Summary</p>")
+			So(post.Image, ShouldEqual, "http://example.com/1.png")
+			So(post.PublishedAt.Equal(time.Date(2018, 11, 18, 10, 0, 0, 0, time.UTC)), ShouldBeTrue)
+		})
+	})
+}
+
+var habrSelectorRule = Rule{
+	Kind:               SelectorRuleKind,
+	ItemPattern:        "article.post_preview",
+	LinkPattern:        "a.post__title_link@href",
+	TitlePattern:       "a.post__title_link",
+	DescriptionPattern: "div.post__text",
+}
+
+func TestSelectorParsing(t *testing.T) {
+	Convey("Test selector parsing", t, func() {
+		Convey("Test compiling selector rule", func() {
+			_, err := CompileRule(&habrSelectorRule)
+			So(err, ShouldBeNil)
+
+			_, err = CompileRule(&Rule{Kind: SelectorRuleKind, ItemPattern: "article[", TitlePattern: "a", LinkPattern: "a@href"})
+			So(err, ShouldNotBeNil)
+
+			_, err = CompileRule(&Rule{Kind: SelectorRuleKind, ItemPattern: "article@id", TitlePattern: "a", LinkPattern: "a@href"})
+			So(err, ShouldNotBeNil)
+
+			for _, itemPattern := range []string{"", " ", "\t\n"} {
+				_, err = CompileRule(&Rule{Kind: SelectorRuleKind, ItemPattern: itemPattern, TitlePattern: "a", LinkPattern: "a@href"})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "compilation rule error: empty item selector")
+			}
+		})
+
+		Convey("Test parsing content by selectors", func() {
+			data, err := ioutil.ReadFile("tests/data/habr.com_response")
+			So(err, ShouldBeNil)
+
+			compiledRule, err := CompileRule(&habrSelectorRule)
+			So(err, ShouldBeNil)
+
+			actualPosts, err := ParseContent(compiledRule, data)
+			So(err, ShouldBeNil)
+			So(len(actualPosts), ShouldEqual, 20)
+
+			expectedPosts, err := getExpectedPosts("tests/data/habr.com_posts")
+			So(err, ShouldBeNil)
+
+			for i, actualPost := range actualPosts {
+				So(actualPost.Title, ShouldEqual, expectedPosts[i].Title)
+				So(actualPost.Link, ShouldEqual, expectedPosts[i].Link)
+				So(actualPost.Description, ShouldNotBeEmpty)
+			}
+		})
+
+		Convey("Test keeping @ inside attribute selectors", func() {
+			data := []byte(`<ul><li><a title="mail@example.com" href="/1">First</a></li><li><a title="other" href="/2">Second</a></li></ul>`)
+			compiledRule, err := CompileRule(&Rule{Kind: SelectorRuleKind, ItemPattern: `li > a[title="mail@example.com"]`, TitlePattern: "", LinkPattern: `@href`})
+			So(err, ShouldBeNil)
+			So(compiledRule.ItemSelector.Attribute, ShouldEqual, "")
+
+			actualPosts, err := ParseContent(compiledRule, data)
+			So(err, ShouldBeNil)
+			So(len(actualPosts), ShouldEqual, 1)
+			So(actualPosts[0].Link, ShouldEqual, "/1")
+
+			selector, err := CompileSelector(`a[title='x@y']@data-id`)
+			So(err, ShouldBeNil)
+			So(selector.Attribute, ShouldEqual, "data-id")
+
+			selector, err = CompileSelector(`a[href$="@x"]`)
+			So(err, ShouldBeNil)
+			So(selector.Attribute, ShouldEqual, "")
+
+			_, err = CompileSelector("a@")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Test extracting attribute of the item itself", func() {
+			data := []byte(`<ul><li><a href="/1">First</a></li><li><a href="/2">Second</a></li></ul>`)
+			compiledRule, err := CompileRule(&Rule{Kind: SelectorRuleKind, ItemPattern: "li > a", TitlePattern: "", LinkPattern: "@href", DescriptionPattern: ""})
+			So(err, ShouldBeNil)
+
+			actualPosts, err := ParseContent(compiledRule, data)
+			So(err, ShouldBeNil)
+			So(len(actualPosts), ShouldEqual, 2)
+			So(actualPosts[1].Title, ShouldEqual, "Second")
+			So(actualPosts[1].Link, ShouldEqual, "/2")
+			So(actualPosts[1].Description, ShouldEqual, "Second")
+		})
+	})
+}
+
+func TestJSONPathParsing(t *testing.T) {
+	Convey("Test jsonpath parsing", t, func() {
+		data := []byte(`{"data": {"items": [
+			{"title": "First", "url": "http://example.com/1", "body": {"text": "One"}, "score": 10},
+			{"title": "Second", "url": "http://example.com/2", "body": {"text": "Two"}, "score": 20}
+		]}}`)
+
+		Convey("Test compiling jsonpath rule", func() {
+			_, err := CompileRule(&Rule{Kind: JSONPathRuleKind, ItemPattern: "data.items", TitlePattern: "$.title", LinkPattern: "$.url"})
+			So(err, ShouldNotBeNil)
+
+			_, err = CompileRule(&Rule{Kind: JSONPathRuleKind, ItemPattern: "", TitlePattern: "$.title", LinkPattern: "$.url"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "compilation rule error: empty item jsonpath")
+
+			_, err = CompileRule(&Rule{Kind: JSONPathRuleKind, ItemPattern: "$.data.items", TitlePattern: " ", LinkPattern: "$.url"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "compilation rule error: empty title jsonpath")
+		})
+
+		Convey("Test parsing content by jsonpath", func() {
+			compiledRule, err := CompileRule(&Rule{
+				Kind:               JSONPathRuleKind,
+				ItemPattern:        "$.data.items",
+				TitlePattern:       "$.title",
+				LinkPattern:        "$.url",
+				DescriptionPattern: "$.body.text",
+			})
+			So(err, ShouldBeNil)
+
+			actualPosts, err := ParseContent(compiledRule, data)
+			So(err, ShouldBeNil)
+			So(len(actualPosts), ShouldEqual, 2)
+			So(actualPosts[1].Title, ShouldEqual, "Second")
+			So(actualPosts[1].Link, ShouldEqual, "http://example.com/2")
+			So(actualPosts[1].Description, ShouldEqual, "Two")
+		})
+
+		Convey("Test converting non-string values", func() {
+			compiledRule, err := CompileRule(&Rule{
+				Kind:         JSONPathRuleKind,
+				ItemPattern:  "$.data.items",
+				TitlePattern: "$.score",
+				LinkPattern:  "$.body",
+			})
+			So(err, ShouldBeNil)
+
+			actualPosts, err := ParseContent(compiledRule, data)
+			So(err, ShouldBeNil)
+			So(actualPosts[0].Title, ShouldEqual, "10")
+			So(actualPosts[0].Link, ShouldEqual, `{"text":"One"}`)
+			So(actualPosts[0].Description, ShouldEqual, "")
+		})
+	})
+}
+
+func TestXPathParsing(t *testing.T) {
+	Convey("Test xpath parsing", t, func() {
+		data := []byte(`<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom" xmlns:media="http://search.yahoo.com/mrss/">
+	<entry>
+		<title>Tom &amp; Jerry</title>
+		<link href="http://example.com/1"/>
+		<content type="xhtml"><div><p>First</p></div></content>
+		<media:thumbnail url="http://example.com/1.png"/>
+	</entry>
+	<entry>
+		<title>Second</title>
+		<link href="http://example.com/2"/>
+		<content type="xhtml"><div><p>Second</p></div></content>
+	</entry>
+</feed>`)
+
+		Convey("Test compiling xpath rule", func() {
+			_, err := CompileRule(&Rule{Kind: XPathRuleKind, ItemPattern: "//entry[", TitlePattern: "title", LinkPattern: "link/@href", DescriptionPattern: "content"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Test parsing content by xpath", func() {
+			compiledRule, err := CompileRule(&Rule{
+				Kind:               XPathRuleKind,
+				ItemPattern:        "//entry",
+				TitlePattern:       "title",
+				LinkPattern:        "link/@href",
+				DescriptionPattern: "content",
+			})
+			So(err, ShouldBeNil)
+
+			actualPosts, err := ParseContent(compiledRule, data)
+			So(err, ShouldBeNil)
+			So(len(actualPosts), ShouldEqual, 2)
+			So(actualPosts[0].Title, ShouldEqual, "Tom & Jerry")
+			So(actualPosts[0].Link, ShouldEqual, "http://example.com/1")
+			So(actualPosts[0].Description, ShouldEqual, "<div><p>First</p></div>")
+		})
+
+		Convey("Test namespaced and scalar xpath expressions", func() {
+			compiledRule, err := CompileRule(&Rule{
+				Kind:               XPathRuleKind,
+				ItemPattern:        "//entry[media:thumbnail]",
+				TitlePattern:       "concat('Re: ', title)",
+				LinkPattern:        "media:thumbnail/@url",
+				DescriptionPattern: "string(content)",
+			})
+			So(err, ShouldBeNil)
+
+			actualPosts, err := ParseContent(compiledRule, data)
+			So(err, ShouldBeNil)
+			So(len(actualPosts), ShouldEqual, 1)
+			So(actualPosts[0].Title, ShouldEqual, "Re: Tom & Jerry")
+			So(actualPosts[0].Link, ShouldEqual, "http://example.com/1.png")
+			So(actualPosts[0].Description, ShouldEqual, "First")
+		})
+	})
+}
+
+func TestPostMetaParsing(t *testing.T) {
+	Convey("Test post meta parsing", t, func() {
+		Convey("Test parsing dates", func() {
+			compiledRule, err := CompileRule(&Rule{Kind: FeedRuleKind})
+			So(err, ShouldBeNil)
+
+			date, err := compiledRule.ParseDate("Sun, 18 Nov 2018 23:32:18 +0000")
+			So(err, ShouldBeNil)
+			So(date.Equal(time.Date(2018, 11, 18, 23, 32, 18, 0, time.UTC)), ShouldBeTrue)
+
+			date, err = compiledRule.ParseDate("")
+			So(err, ShouldBeNil)
+			So(date, ShouldBeNil)
+
+			_, err = compiledRule.ParseDate("yesterday")
+			So(err, ShouldNotBeNil)
+
+			compiledRule.DateLayout = "02.01.2006 15:04"
+			date, err = compiledRule.ParseDate("18.11.2018 23:32")
+			So(err, ShouldBeNil)
+			So(date.Equal(time.Date(2018, 11, 18, 23, 32, 0, 0, time.UTC)), ShouldBeTrue)
+		})
+
+		Convey("Test parsing optional regexp patterns", func() {
+			data, err := ioutil.ReadFile("tests/data/habr.com_response")
+			So(err, ShouldBeNil)
+
+			rule := habrRule
+			rule.AuthorPattern = "<span\\sclass=\"user-info__nickname user-info__nickname_small\">(.*?)</span>"
+			rule.ImagePattern = "(?s)post__text.*?<img\\ssrc=\"(.*?)\""
+			rule.GUIDPattern = "no-such-pattern-(.*)"
+			compiledRule, err := CompileRule(&rule)
+			So(err, ShouldBeNil)
+
+			actualPosts, err := ParseContent(compiledRule, []byte(html.UnescapeString(string(data))))
+			So(err, ShouldBeNil)
+			So(len(actualPosts), ShouldEqual, 20)
+			So(actualPosts[0].Author, ShouldEqual, "sfi0zy")
+			So(actualPosts[0].Image, ShouldEqual, "https://habrastorage.org/webt/fr/eg/ci/fregcimp3zp_edqlwjr31mkusca.jpeg")
+			So(actualPosts[0].GUID, ShouldEqual, "")
+			So(actualPosts[0].PublishedAt, ShouldBeNil)
+		})
+
+		Convey("Test requiring regexp patterns", func() {
+			_, err := CompileRule(&Rule{})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "compilation rule error: empty item regexp")
+
+			rule := habrRule
+			rule.TitlePattern = ""
+			_, err = CompileRule(&rule)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "compilation rule error: empty title regexp")
+
+			rule = habrRule
+			rule.LinkPattern = " "
+			_, err = CompileRule(&rule)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "compilation rule error: empty link regexp")
+		})
+
+		Convey("Test parsing optional jsonpath patterns", func() {
+			data := []byte(`{"items": [{"title": "First", "url": "http://example.com/1", "date": "2018-11-18", "id": 42}]}`)
+			compiledRule, err := CompileRule(&Rule{
+				Kind:         JSONPathRuleKind,
+				ItemPattern:  "$.items",
+				TitlePattern: "$.title",
+				LinkPattern:  "$.url",
+				DatePattern:  "$.date",
+				DateLayout:   "2006-01-02",
+				GUIDPattern:  "$.id",
+			})
+			So(err, ShouldBeNil)
+
+			actualPosts, err := ParseContent(compiledRule, data)
+			So(err, ShouldBeNil)
+			So(actualPosts[0].GUID, ShouldEqual, "42")
+			So(actualPosts[0].PublishedAt.Equal(time.Date(2018, 11, 18, 0, 0, 0, 0, time.UTC)), ShouldBeTrue)
+		})
+	})
+}
+
+func TestParsingTolerance(t *testing.T) {
+	Convey("Test parsing tolerance", t, func() {
+		content := []byte(`
+<item><a href="/1">First</a><p>One</p></item>
+<item><a href="/2">Second</a></item>
+<item><p>Advertisement</p></item>
+<item><a href="/4">Fourth</a><p>Four</p></item>`)
+		rule := Rule{
+			ItemPattern:        "(?s)<item>(.*?)</item>",
+			TitlePattern:       "<a href=\".*?\">(.*?)</a>",
+			LinkPattern:        "<a href=\"(.*?)\">",
+			DescriptionPattern: "<p>(.*?)</p>",
+		}
+
+		Convey("Test failing on the first bad item by default", func() {
+			compiledRule, err := CompileRule(&rule)
+			So(err, ShouldBeNil)
+			_, report, err := ParseContentWithReport(compiledRule, content)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "empty or multiple description by regexp")
+			So(len(report.Warnings), ShouldEqual, 2)
+		})
+
+		Convey("Test skipping bad items under the threshold", func() {
+			rule.MaxBadItemsShare = 0.5
+			compiledRule, err := CompileRule(&rule)
+			So(err, ShouldBeNil)
+			posts, report, err := ParseContentWithReport(compiledRule, content)
+			So(err, ShouldBeNil)
+			So(len(posts), ShouldEqual, 2)
+			So(posts[1].Title, ShouldEqual, "Fourth")
+			So(report.Warnings, ShouldResemble, []string{
+				"item 2 skipped: empty or multiple description by regexp",
+				"item 3 skipped: empty or multiple title by regexp",
+			})
+			So(report.ItemsCount, ShouldEqual, 4)
+			So(report.Patterns["title"].Matched, ShouldEqual, 3)
+			So(report.Patterns["link"].FailedItems, ShouldResemble, []int{3})
+			So(report.Patterns["description"].FailedItems, ShouldResemble, []int{2})
+
+			rule.MaxBadItemsShare = 0.25
+			compiledRule, err = CompileRule(&rule)
+			So(err, ShouldBeNil)
+			_, _, err = ParseContentWithReport(compiledRule, content)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "2 of 4 items are bad")
+		})
+
+		Convey("Test allowing optional fields to be empty", func() {
+			rule.OptionalFields = "description"
+			rule.MaxBadItemsShare = 0.25
+			compiledRule, err := CompileRule(&rule)
+			So(err, ShouldBeNil)
+			posts, report, err := ParseContentWithReport(compiledRule, content)
+			So(err, ShouldBeNil)
+			So(len(posts), ShouldEqual, 3)
+			So(posts[1].Description, ShouldEqual, "")
+			So(len(report.Warnings), ShouldEqual, 1)
+		})
+
+		Convey("Test tolerance of selector rules", func() {
+			compiledRule, err := CompileRule(&Rule{
+				Kind:               SelectorRuleKind,
+				ItemPattern:        "item",
+				TitlePattern:       "a",
+				LinkPattern:        "a@href",
+				DescriptionPattern: "p",
+				OptionalFields:     "Title, description",
+				MaxBadItemsShare:   0.5,
+			})
+			So(err, ShouldBeNil)
+			posts, report, err := ParseContentWithReport(compiledRule, content)
+			So(err, ShouldBeNil)
+			So(len(posts), ShouldEqual, 3)
+			So(report.Warnings, ShouldResemble, []string{"item 3 skipped: can not find link by selector"})
+		})
+
+		Convey("Test validating tolerance", func() {
+			rule.OptionalFields = "link"
+			_, err := CompileRule(&rule)
+			So(err, ShouldNotBeNil)
+			rule.OptionalFields = ""
+			rule.MaxBadItemsShare = 1.5
+			_, err = CompileRule(&rule)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Test skipping feed entries without link and guid", func() {
+			feed := []byte(`<rss><channel>
+<item><title>First</title><link>https://example.com/1</link></item>
+<item><title>Broken</title></item>
+</channel></rss>`)
+			compiledRule, err := CompileRule(&Rule{Kind: FeedRuleKind})
+			So(err, ShouldBeNil)
+			posts, report, err := ParseContentWithReport(compiledRule, feed)
+			So(err, ShouldBeNil)
+			So(len(posts), ShouldEqual, 1)
+			So(report.Warnings, ShouldResemble, []string{"item 2 skipped: it has neither link nor guid"})
+		})
+	})
+}
+
+func TestRuleDryRun(t *testing.T) {
+	Convey("Test rule dry run", t, func() {
+		content := []byte(`<html><body>
+<div class="post"><a href="/1">First</a><p>One</p><time>2018-11-18</time></div>
+<div class="post"><a href="/2">Second</a><time>yesterday</time></div>
+</body></html>`)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(content)
+		}))
+		defer ts.Close()
+		rule := Rule{
+			Kind:               SelectorRuleKind,
+			ItemPattern:        "div.post",
+			TitlePattern:       "a",
+			LinkPattern:        "a@href",
+			DescriptionPattern: "p",
+			DatePattern:        "time",
+			DateLayout:         "2006-01-02",
+		}
+
+		Convey("Test reporting failed patterns", func() {
+			result := DryRunRule(ts.URL, &rule, &RequestConfig{})
+			So(result.Error, ShouldEqual, "getting content error: can not find description by selector")
+			So(result.StatusCode, ShouldEqual, http.StatusOK)
+			So(result.ItemsCount, ShouldEqual, 2)
+			So(result.Patterns["link"].Matched, ShouldEqual, 2)
+			So(result.Patterns["description"].FailedItems, ShouldResemble, []int{2})
+			So(result.Patterns["date"].FailedItems, ShouldResemble, []int{2})
+			So(result.Patterns["author"], ShouldBeNil)
+			So(len(result.Posts), ShouldEqual, 0)
+		})
+
+		Convey("Test keeping escaped markup of feed descriptions", func() {
+			feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Example</title>
+<item><title>First</title><link>http://example.com/1</link><description>&amp;lt;script&amp;gt;</description></item>
+</channel></rss>`))
+			}))
+			defer feed.Close()
+
+			result := DryRunRule(feed.URL, &Rule{Kind: FeedRuleKind}, &RequestConfig{})
+			So(result.Error, ShouldEqual, "")
+			So(len(result.Posts), ShouldEqual, 1)
+			So(result.Posts[0].Description, ShouldEqual, "&lt;script&gt;")
+		})
+
+		Convey("Test returning parsed posts", func() {
+			rule.OptionalFields = "description"
+			rule.DatePattern = ""
+			result := DryRunRule(ts.URL, &rule, &RequestConfig{})
+			So(result.Error, ShouldEqual, "")
+			So(len(result.Posts), ShouldEqual, 2)
+			So(result.Posts[1].Link, ShouldEqual, ts.URL+"/2")
+			So(result.Patterns["description"].FailedItems, ShouldResemble, []int{2})
+		})
+
+		Convey("Test keeping items with unparsable dates", func() {
+			rule.OptionalFields = "description"
+			result := DryRunRule(ts.URL, &rule, &RequestConfig{})
+			So(result.Error, ShouldEqual, "")
+			So(len(result.Posts), ShouldEqual, 2)
+			So(result.Posts[0].PublishedAt, ShouldNotBeNil)
+			So(result.Posts[1].PublishedAt, ShouldBeNil)
+			So(result.Patterns["date"].FailedItems, ShouldResemble, []int{2})
+			So(len(result.Warnings), ShouldEqual, 1)
+			So(result.Warnings[0], ShouldStartWith, "item 2 kept without date: date parsing error")
+		})
+
+		Convey("Test reporting bad rules and request configs", func() {
+			rule.Kind = "unknown"
+			So(DryRunRule(ts.URL, &rule, &RequestConfig{}).Error, ShouldStartWith, "compilation rule error")
+			rule.Kind = SelectorRuleKind
+			So(DryRunRule(ts.URL, &rule, &RequestConfig{Password: "secret"}).Error, ShouldStartWith, "bad request config")
+		})
+
+		Convey("Test testing the rule from the form", func() {
+			form := url.Values{
+				"channel_source":      {ts.URL},
+				"rule_kind":           {SelectorRuleKind},
+				"item_pattern":        {"div.post"},
+				"title_pattern":       {"a"},
+				"link_pattern":        {"a@href"},
+				"description_pattern": {"p"},
+				"optional_fields":     {"description"},
+			}
+			request := httptest.NewRequest(http.MethodPost, "/testrule", strings.NewReader(form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			recorder := httptest.NewRecorder()
+			DryRunRuleHandler(recorder, request)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Body.String(), ShouldContainSubstring, `"Error":""`)
+		})
+
+		Convey("Test sending stored request settings only to the channel origin", func() {
+			var authorization string
+			otherTs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authorization = r.Header.Get("Authorization")
+				w.Write(content)
+			}))
+			defer otherTs.Close()
+			So(SameOrigin("HTTP://Example.com:80/feed", "http://example.com/other"), ShouldBeTrue)
+			So(SameOrigin("https://example.com/feed", "http://example.com/feed"), ShouldBeFalse)
+			So(SameOrigin(ts.URL, otherTs.URL), ShouldBeFalse)
+
+			channel := Channel{Source: otherTs.URL + "/feed"}
+			storedRequestConfig := RequestConfig{Headers: "Authorization: Bearer secret"}
+			form := url.Values{"channel_source": {ts.URL}, "request_headers": {""}}
+			requestConfig := dryRunRequestConfig(form, &channel, &storedRequestConfig)
+			So(requestConfig.Headers, ShouldEqual, "")
+
+			channel.Source = ts.URL + "/feed"
+			form.Set("channel_source", otherTs.URL)
+			requestConfig = dryRunRequestConfig(form, &channel, &storedRequestConfig)
+			DryRunRule(otherTs.URL, &rule, &requestConfig)
+			So(authorization, ShouldEqual, "")
+
+			channel.Source = otherTs.URL + "/feed"
+			requestConfig = dryRunRequestConfig(form, &channel, &storedRequestConfig)
+			DryRunRule(otherTs.URL, &rule, &requestConfig)
+			So(authorization, ShouldEqual, "Bearer secret")
+		})
+	})
+}
+
+func TestChannelsAPI(t *testing.T) {
+	Convey("Test channels API", t, func() {
+		serve := func(method, path, body string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			ChannelsAPIHandler(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+			return recorder
+		}
+		decodeError := func(recorder *httptest.ResponseRecorder) APIError {
+			var response APIErrorResponse
+			So(json.Unmarshal(recorder.Body.Bytes(), &response), ShouldBeNil)
+			return response.Error
+		}
+
+		Convey("Test rejecting bad requests", func() {
+			recorder := serve(http.MethodGet, APIPrefix+"/channels/abc", "")
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+			So(recorder.Header().Get("Content-Type"), ShouldEqual, "application/json")
+			So(decodeError(recorder).Code, ShouldEqual, "bad_request")
+
+			recorder = serve(http.MethodPost, APIPrefix+"/channels", "{")
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+			So(decodeError(recorder).Message, ShouldStartWith, "decoding channel error")
+
+			recorder = serve(http.MethodPatch, APIPrefix+"/channels/1", "")
+			So(recorder.Code, ShouldEqual, http.StatusMethodNotAllowed)
+			So(recorder.Header().Get("Allow"), ShouldEqual, "GET, PUT, DELETE")
+			So(decodeError(recorder).Code, ShouldEqual, "method_not_allowed")
+
+			So(serve(http.MethodGet, APIPrefix+"/channels/1/unknown", "").Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Test rejecting bad rule templates", func() {
+			recorder := httptest.NewRecorder()
+			RulesAPIHandler(recorder, httptest.NewRequest(http.MethodPost, APIPrefix+"/rules", strings.NewReader(`{"Kind": "feed"}`)))
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+			So(decodeError(recorder).Code, ShouldEqual, "validation_error")
+
+			recorder = httptest.NewRecorder()
+			RulesAPIHandler(recorder, httptest.NewRequest(http.MethodDelete, APIPrefix+"/rules/1", nil))
+			So(recorder.Code, ShouldEqual, http.StatusMethodNotAllowed)
+			So(recorder.Header().Get("Allow"), ShouldEqual, "GET, PUT")
+		})
+
+		Convey("Test marshalling posts without channels", func() {
+			rawPage, err := json.Marshal(PostsPage{Posts: []Post{{Title: "Post", ChannelID: 1}}})
+			So(err, ShouldBeNil)
+			So(string(rawPage), ShouldContainSubstring, `"ChannelID":1`)
+			So(string(rawPage), ShouldNotContainSubstring, `"Channel":`)
+		})
+
+		Convey("Test reading posts queries", func() {
+			query, err := postsQueryFromRequest(httptest.NewRequest(http.MethodGet, APIPrefix+"/posts", nil))
+			So(err, ShouldBeNil)
+			So(*query, ShouldResemble, PostsQuery{Limit: PostsPageSize})
+
+			cursor := encodeCursor(&PostsCursor{Date: time.Date(2018, 11, 18, 12, 0, 0, 5, time.UTC), ID: 42})
+			query, err = postsQueryFromRequest(httptest.NewRequest(http.MethodGet,
+				APIPrefix+"/posts?limit=5&order=asc&title=go&since=2018-11-01&until=2018-11-30T00:00:00Z&cursor="+cursor, nil))
+			So(err, ShouldBeNil)
+			So(query.Limit, ShouldEqual, 5)
+			So(query.Ascending, ShouldBeTrue)
+			So(query.Title, ShouldEqual, "go")
+			So(query.Since.Equal(time.Date(2018, 11, 1, 0, 0, 0, 0, time.UTC)), ShouldBeTrue)
+			So(query.Until.Equal(time.Date(2018, 11, 30, 0, 0, 0, 0, time.UTC)), ShouldBeTrue)
+			So(query.After.ID, ShouldEqual, 42)
+			So(query.After.Date.Equal(time.Date(2018, 11, 18, 12, 0, 0, 5, time.UTC)), ShouldBeTrue)
+
+			for _, rawQuery := range []string{"limit=0", "limit=1000", "order=random", "since=yesterday", "cursor=***"} {
+				recorder := httptest.NewRecorder()
+				PostsAPIHandler(recorder, httptest.NewRequest(http.MethodGet, APIPrefix+"/posts?"+rawQuery, nil))
+				So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+				So(decodeError(recorder).Code, ShouldEqual, "bad_request")
+			}
+		})
+
+		Convey("Test writing intervals as durations", func() {
+			var input ChannelInput
+			So(json.Unmarshal([]byte(`{"Name": "Example", "RefreshInterval": "30m"}`), &input), ShouldBeNil)
+			So(input.channel().RefreshInterval, ShouldEqual, time.Minute*30)
+			So(json.Unmarshal([]byte(`{"RefreshInterval": 1800000000000}`), &input), ShouldNotBeNil)
+
+			recorder := serve(http.MethodPost, APIPrefix+"/channels", `{"Name": "Example", "Source": "http://example.com", "RefreshInterval": 60}`)
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+			So(decodeError(recorder).Code, ShouldEqual, "bad_request")
+
+			channel := Channel{Name: "Example", RefreshInterval: time.Hour * 168, AdaptiveInterval: time.Minute * 90}
+			rawChannel, err := json.Marshal(newChannelOutput(&channel))
+			So(err, ShouldBeNil)
+			var output map[string]interface{}
+			So(json.Unmarshal(rawChannel, &output), ShouldBeNil)
+			So(output["Name"], ShouldEqual, "Example")
+			So(output["RefreshInterval"], ShouldEqual, "168h0m0s")
+			So(output["AdaptiveInterval"], ShouldEqual, "1h30m0s")
+
+			So(json.Unmarshal(rawChannel, &input), ShouldBeNil)
+			So(input.RefreshInterval.Duration, ShouldEqual, time.Hour*168)
+		})
+
+		Convey("Test hiding internal error details", func() {
+			recorder := httptest.NewRecorder()
+			writeDBError(recorder, errors.New("pq: relation \"channels\" does not exist"))
+			So(recorder.Code, ShouldEqual, http.StatusInternalServerError)
+			So(decodeError(recorder), ShouldResemble, APIError{Code: "internal_error", Message: "internal server error"})
+		})
+
+		Convey("Test validating channels before saving", func() {
+			recorder := serve(http.MethodPost, APIPrefix+"/channels", `{"Name": "", "Source": "http://example.com"}`)
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+			So(decodeError(recorder), ShouldResemble, APIError{Code: "validation_error", Message: "db error, empty channel name"})
+
+			recorder = serve(http.MethodPost, APIPrefix+"/channels", `{"Name": "Example", "Source": "example.com"}`)
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+			So(decodeError(recorder).Message, ShouldContainSubstring, "http or https url")
+
+			recorder = serve(http.MethodPost, APIPrefix+"/channels",
+				`{"Name": "Example", "Source": "http://example.com", "Rule": {"Kind": "selector"}}`)
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+			So(decodeError(recorder).Message, ShouldContainSubstring, "compilation rule error")
+			So(decodeError(recorder).Message, ShouldNotContainSubstring, "db error: db error")
+
+			recorder = serve(http.MethodPost, APIPrefix+"/channels",
+				`{"Name": "Example", "Source": "http://example.com", "Rule": {"Kind": "feed"}, "RequestConfig": {"Headers": "Broken"}}`)
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+			So(decodeError(recorder).Message, ShouldContainSubstring, "bad request config")
+		})
+	})
+}
+
+func TestRuleDiff(t *testing.T) {
+	Convey("Test rule diff", t, func() {
+		oldRule := Rule{Kind: RegexpRuleKind, ItemPattern: "(?s)<item>(.*?)</item>", MaxBadItemsShare: 0.1}
+		oldRule.ID = 1
+		newRule := Rule{Kind: SelectorRuleKind, ItemPattern: "(?s)<item>(.*?)</item>", StripTrackingParams: true}
+		newRule.ID = 2
+		So(DiffRules(&oldRule, &newRule), ShouldResemble, []RuleFieldChange{
+			{Field: "Kind", Old: "regexp", New: "selector"},
+			{Field: "StripTrackingParams", Old: "false", New: "true"},
+			{Field: "MaxBadItemsShare", Old: "0.1", New: "0"},
+		})
+		So(DiffRules(&oldRule, &oldRule), ShouldBeEmpty)
+	})
+}
+
+func TestChannelPages(t *testing.T) {
+	Convey("Test channel editing pages", t, func() {
+		var pageTemplater Templater
+		pageTemplater.Init("templates")
+		channel := Channel{Name: "Habr", Source: "https://habr.com", Rule: Rule{
+			Kind:                SelectorRuleKind,
+			ItemPattern:         "article.post_preview",
+			LinkPattern:         "a.post__title_link@href",
+			StripTrackingParams: true,
+		}}
+		channel.ID = 42
+		channel.RuleID = 7
+		feedTemplate := RuleTemplate{Rule: Rule{Name: "RSS 2.0 / Atom feed", Kind: FeedRuleKind}, ChannelsCount: 3}
+		feedTemplate.ID = 5
+		var page bytes.Buffer
+		err := pageTemplater.GetTemplate("editchannel").Execute(&page, struct {
+			Channels          []Channel
+			Channel           *Channel
+			RefreshInterval   string
+			Templates         []RuleTemplate
+			RuleChannelsCount int
+		}{Channels: []Channel{channel}, Channel: &channel, RefreshInterval: "30m0s", Templates: []RuleTemplate{feedTemplate}, RuleChannelsCount: 1})
+		So(err, ShouldBeNil)
+		So(page.String(), ShouldContainSubstring, `<option value="" selected>Own rule`)
+		So(page.String(), ShouldContainSubstring, `<option value="5">Template RSS 2.0 / Atom feed`)
+		So(page.String(), ShouldNotContainSubstring, "The rule is shared")
+		So(page.String(), ShouldContainSubstring, `action="/updatechannel/42"`)
+		So(page.String(), ShouldContainSubstring, `name="item_pattern" value="article.post_preview"`)
+		So(page.String(), ShouldContainSubstring, `<option value="selector" selected>`)
+		So(page.String(), ShouldContainSubstring, `name="refresh_interval" value="30m0s"`)
+		So(page.String(), ShouldContainSubstring, `name="strip_tracking_params" value="on" checked`)
+		So(page.String(), ShouldContainSubstring, `href="/rulehistory/`)
+
+		oldSnapshot, err := snapshotRule(Rule{Kind: FeedRuleKind})
+		So(err, ShouldBeNil)
+		newSnapshot, err := snapshotRule(channel.Rule)
+		So(err, ShouldBeNil)
+		versions := []RuleVersion{{RuleID: 7, Author: "alice", Snapshot: newSnapshot}, {RuleID: 7, Snapshot: oldSnapshot}}
+		versions[0].ID = 2
+		versions[1].ID = 1
+		history, err := ruleHistory(versions)
+		So(err, ShouldBeNil)
+		page.Reset()
+		err = pageTemplater.GetTemplate("rulehistory").Execute(&page, struct {
+			Channels     []Channel
+			RuleID       uint64
+			RuleChannels []Channel
+			History      []RuleHistoryEntry
+		}{Channels: []Channel{channel}, RuleID: 7, RuleChannels: []Channel{channel}, History: history})
+		So(err, ShouldBeNil)
+		So(page.String(), ShouldContainSubstring, "Version 2 (current)")
+		So(page.String(), ShouldContainSubstring, "by alice")
+		So(page.String(), ShouldContainSubstring, `<code>article.post_preview</code>`)
+		So(page.String(), ShouldContainSubstring, `action="/rollbackrule/7"`)
+		So(page.String(), ShouldContainSubstring, `name="version_id" value="1"`)
+
+		page.Reset()
+		err = pageTemplater.GetTemplate("ruletemplates").Execute(&page, struct {
+			Channels  []Channel
+			Templates []RuleTemplate
+		}{Channels: []Channel{channel}, Templates: []RuleTemplate{feedTemplate}})
+		So(err, ShouldBeNil)
+		So(page.String(), ShouldContainSubstring, "<td>RSS 2.0 / Atom feed</td>")
+		So(page.String(), ShouldContainSubstring, "<td>3</td>")
+		So(page.String(), ShouldContainSubstring, `href="/editrule/5"`)
+
+		page.Reset()
+		err = pageTemplater.GetTemplate("editrule").Execute(&page, struct {
+			Channels     []Channel
+			Rule         *Rule
+			RuleChannels []Channel
+		}{Channels: []Channel{channel}, Rule: &feedTemplate.Rule, RuleChannels: []Channel{channel}})
+		So(err, ShouldBeNil)
+		So(page.String(), ShouldContainSubstring, `action="/updaterule/5"`)
+		So(page.String(), ShouldContainSubstring, `name="rule_name" value="RSS 2.0 / Atom feed"`)
+		So(page.String(), ShouldContainSubstring, `<option value="feed" selected>`)
+		So(page.String(), ShouldContainSubstring, `href="/editchannel/42"`)
+	})
+}
+
+func TestPostIdentity(t *testing.T) {
+	Convey("Test post identity", t, func() {
+		Convey("Test normalizing links", func() {
+			So(NormalizeLink(" HTTPS://Example.com:443/a/b/#comments "), ShouldEqual, "https://example.com/a/b")
+			So(NormalizeLink("http://example.com:8080/a?x=1"), ShouldEqual, "http://example.com:8080/a?x=1")
+			So(NormalizeLink("/relative/link/"), ShouldEqual, "/relative/link/")
+		})
+
+		Convey("Test identity prefers guid over link", func() {
+			So(PostIdentity(&Post{GUID: "42", Link: "http://example.com/1"}), ShouldEqual, "guid:42")
+			So(PostIdentity(&Post{Link: "http://Example.com/1/"}), ShouldEqual, PostIdentity(&Post{Link: "http://example.com/1"}))
+		})
+	})
+}
+
+func TestConditionalDownload(t *testing.T) {
+	Convey("Test conditional download", t, func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") == "\"v1\"" || r.Header.Get("If-Modified-Since") == "Mon, 01 Jan 2018 00:00:00 GMT" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", "\"v1\"")
+			w.Header().Set("Last-Modified", "Mon, 01 Jan 2018 00:00:00 GMT")
+			w.Write([]byte("content"))
+		}))
+		defer ts.Close()
+
+		Convey("Test downloading without validators", func() {
+			content, info, err := DownloadContent(ts.URL, CacheValidators{}, nil)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "content")
+			So(info.NotModified, ShouldBeFalse)
+			So(info.StatusCode, ShouldEqual, http.StatusOK)
+			So(info.BytesCount, ShouldEqual, len("content"))
+			So(info.Validators, ShouldResemble, CacheValidators{ETag: "\"v1\"", LastModified: "Mon, 01 Jan 2018 00:00:00 GMT"})
+		})
+
+		Convey("Test downloading not modified content", func() {
+			content, info, err := DownloadContent(ts.URL, CacheValidators{ETag: "\"v1\""}, nil)
+			So(err, ShouldBeNil)
+			So(content, ShouldBeNil)
+			So(info.NotModified, ShouldBeTrue)
+			So(info.StatusCode, ShouldEqual, http.StatusNotModified)
+			So(info.Validators.ETag, ShouldEqual, "\"v1\"")
+
+			_, info, err = DownloadContent(ts.URL, CacheValidators{LastModified: "Mon, 01 Jan 2018 00:00:00 GMT"}, nil)
+			So(err, ShouldBeNil)
+			So(info.NotModified, ShouldBeTrue)
+		})
+
+		Convey("Test getting not modified content", func() {
+			rule, err := CompileRule(&Rule{Kind: FeedRuleKind})
+			So(err, ShouldBeNil)
+			posts, info, err := GetContentWithInfo(ts.URL, rule, CacheValidators{ETag: "\"v1\""}, nil)
+			So(err, ShouldBeNil)
+			So(posts, ShouldBeEmpty)
+			So(info.NotModified, ShouldBeTrue)
+		})
+	})
+}
+
+func TestCharsetDecoding(t *testing.T) {
+	Convey("Test charset decoding", t, func() {
+		encode := func(encoding *charmap.Charmap, value string) []byte {
+			encoded, err := encoding.NewEncoder().Bytes([]byte(value))
+			So(err, ShouldBeNil)
+			return encoded
+		}
+
+		Convey("Test detecting charset", func() {
+			So(DetectCharset([]byte("<p>привет</p>"), ""), ShouldEqual, "utf-8")
+			So(DetectCharset([]byte("<p>hello</p>"), "text/html; charset=windows-1251"), ShouldEqual, "windows-1251")
+			So(DetectCharset([]byte("<?xml version=\"1.0\" encoding=\"KOI8-R\"?><rss/>"), "text/xml"), ShouldEqual, "koi8-r")
+			So(DetectCharset(encode(charmap.Windows1251, "<meta charset=\"windows-1251\"><p>привет</p>"), "text/html"), ShouldEqual, "windows-1251")
+		})
+
+		Convey("Test decoding content by Content-Type charset", func() {
+			content, err := DecodeContent(encode(charmap.Windows1251, "<h1>Новости</h1>"), "text/html; charset=cp1251")
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "<h1>Новости</h1>")
+		})
+
+		Convey("Test decoding content by meta tag", func() {
+			content, err := DecodeContent(encode(charmap.KOI8R, "<meta http-equiv=\"Content-Type\" content=\"text/html; charset=koi8-r\"><h1>Новости</h1>"), "text/html")
+			So(err, ShouldBeNil)
+			So(string(content), ShouldContainSubstring, "<h1>Новости</h1>")
+		})
+
+		Convey("Test decoding feed by xml declaration", func() {
+			feed := "<?xml version=\"1.0\" encoding=\"windows-1251\"?><rss><channel><item>" +
+				"<title>Заголовок</title><link>https://example.com/1</link><description>Описание</description>" +
+				"</item></channel></rss>"
+			content, err := DecodeContent(encode(charmap.Windows1251, feed), "application/rss+xml")
+			So(err, ShouldBeNil)
+			So(string(content), ShouldStartWith, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>")
+
+			posts, err := ParseFeed(content)
+			So(err, ShouldBeNil)
+			So(len(posts), ShouldEqual, 1)
+			So(posts[0].Title, ShouldEqual, "Заголовок")
+
+			rule, err := CompileRule(&Rule{Kind: XPathRuleKind, ItemPattern: "//item", TitlePattern: "title", LinkPattern: "link", DescriptionPattern: "description"})
+			So(err, ShouldBeNil)
+			posts, err = ParseContent(rule, content)
+			So(err, ShouldBeNil)
+			So(posts[0].Description, ShouldEqual, "Описание")
+		})
+
+		Convey("Test getting content in legacy charset", func() {
+			page := encode(charmap.Windows1251, "<div class=\"post\"><a href=\"/1\">Привет, мир</a><p>Текст</p></div>")
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html; charset=windows-1251")
+				w.Write(page)
+			}))
+			defer ts.Close()
+			rule, err := CompileRule(&Rule{Kind: SelectorRuleKind, ItemPattern: "div.post", TitlePattern: "a", LinkPattern: "a@href", DescriptionPattern: "p"})
+			So(err, ShouldBeNil)
+			posts, err := GetContent(ts.URL, rule)
+			So(err, ShouldBeNil)
+			So(len(posts), ShouldEqual, 1)
+			So(posts[0].Title, ShouldEqual, "Привет, мир")
+		})
+	})
+}
+
+func TestFetcher(t *testing.T) {
+	Convey("Test fetcher", t, func() {
+		var userAgent string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userAgent = r.Header.Get("User-Agent")
+			switch r.URL.Path {
+			case "/missing":
+				http.NotFound(w, r)
+			case "/slow":
+				time.Sleep(200 * time.Millisecond)
+				w.Write([]byte("slow"))
+			default:
+				w.Write([]byte("0123456789"))
+			}
+		}))
+		defer ts.Close()
+
+		config := FetcherConfig{MaxBodySize: 10, ReadTimeout: Duration{50 * time.Millisecond}, RetryInterval: Duration{time.Millisecond}}
+		config.setDefaults()
+		var testFetcher Fetcher
+		So(testFetcher.Init(&config), ShouldBeNil)
+
+		Convey("Test sending user agent", func() {
+			content, _, err := testFetcher.Download(ts.URL, CacheValidators{}, nil)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "0123456789")
+			So(userAgent, ShouldEqual, DefaultUserAgent)
+		})
+
+		Convey("Test limiting body size", func() {
+			testFetcher.maxBodySize = 5
+			_, info, err := testFetcher.Download(ts.URL, CacheValidators{}, nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "larger than 5 bytes")
+			So(info.BytesCount, ShouldEqual, 6)
+		})
+
+		Convey("Test validating status code", func() {
+			_, info, err := testFetcher.Download(ts.URL+"/missing", CacheValidators{}, nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "unexpected status 404")
+			So(info.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Test timing out on slow upstream", func() {
+			_, _, err := testFetcher.Download(ts.URL+"/slow", CacheValidators{}, nil)
+			So(err, ShouldNotBeNil)
+			So(IsTemporaryError(err), ShouldBeTrue)
+		})
+
+		Convey("Test refused connections are not temporary", func() {
+			closedTs := httptest.NewServer(http.NotFoundHandler())
+			closedTs.Close()
+			_, _, err := testFetcher.Download(closedTs.URL, CacheValidators{}, nil)
+			So(err, ShouldNotBeNil)
+			So(IsTemporaryError(err), ShouldBeFalse)
+		})
+
+		Convey("Test applying request config", func() {
+			var request *http.Request
+			authTs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				request = r
+			}))
+			defer authTs.Close()
+
+			requestConfig := RequestConfig{
+				Headers:  "Authorization: Bearer token\nX-Team:  news \n",
+				Cookies:  "session=abc; lang=en",
+				Username: "user",
+				Password: "secret",
+			}
+			So(requestConfig.Validate(), ShouldBeNil)
+			_, _, err := testFetcher.Download(authTs.URL, CacheValidators{}, &requestConfig)
+			So(err, ShouldBeNil)
+			So(request.Header.Get("X-Team"), ShouldEqual, "news")
+			cookie, err := request.Cookie("lang")
+			So(err, ShouldBeNil)
+			So(cookie.Value, ShouldEqual, "en")
+			username, password, ok := request.BasicAuth()
+			So(ok, ShouldBeTrue)
+			So(username, ShouldEqual, "user")
+			So(password, ShouldEqual, "secret")
+		})
+
+		Convey("Test validating request config", func() {
+			So((&RequestConfig{Headers: "no colon"}).Validate(), ShouldNotBeNil)
+			So((&RequestConfig{Cookies: "; ;"}).Validate(), ShouldNotBeNil)
+			So((&RequestConfig{Password: "secret"}).Validate(), ShouldNotBeNil)
+			So((&RequestConfig{}).Validate(), ShouldBeNil)
+		})
+
+		Convey("Test retrying temporary errors", func() {
+			requestsCount := 0
+			flakyTs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requestsCount++
+				switch {
+				case r.URL.Path == "/missing":
+					http.NotFound(w, r)
+				case r.URL.Path == "/limited":
+					w.Header().Set("Retry-After", "3600")
+					w.WriteHeader(http.StatusTooManyRequests)
+				case requestsCount < 3:
+					w.WriteHeader(http.StatusServiceUnavailable)
+				default:
+					w.Write([]byte("content"))
+				}
+			}))
+			defer flakyTs.Close()
+
+			_, _, err := testFetcher.Download(flakyTs.URL, CacheValidators{}, nil)
+			So(IsTemporaryError(err), ShouldBeTrue)
+			So(requestsCount, ShouldEqual, 1)
+			delay, ok := testFetcher.RetryDelay(1, err)
+			So(ok, ShouldBeTrue)
+			So(delay, ShouldEqual, time.Millisecond)
+			delay, ok = testFetcher.RetryDelay(2, err)
+			So(ok, ShouldBeTrue)
+			So(delay, ShouldEqual, time.Millisecond*2)
+			_, ok = testFetcher.RetryDelay(3, err)
+			So(ok, ShouldBeFalse)
+
+			requestsCount = 0
+			_, _, err = testFetcher.Download(flakyTs.URL+"/missing", CacheValidators{}, nil)
+			So(err, ShouldNotBeNil)
+			So(IsTemporaryError(err), ShouldBeFalse)
+			So(requestsCount, ShouldEqual, 1)
+
+			requestsCount = 0
+			_, _, err = testFetcher.Download(flakyTs.URL+"/limited", CacheValidators{}, nil)
+			So(IsTemporaryError(err), ShouldBeTrue)
+			So(err.(*FetchError).RetryAfter, ShouldEqual, time.Hour)
+			So(requestsCount, ShouldEqual, 1)
+			_, ok = testFetcher.RetryDelay(1, err)
+			So(ok, ShouldBeFalse)
+			So(IsTemporaryError(wrapError("getting content error: ", err)), ShouldBeTrue)
+		})
+
+		Convey("Test parsing Retry-After", func() {
+			now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+			So(parseRetryAfter("120", now), ShouldEqual, time.Minute*2)
+			So(parseRetryAfter("Mon, 01 Jan 2018 00:00:30 GMT", now), ShouldEqual, time.Second*30)
+			So(parseRetryAfter("Sun, 31 Dec 2017 00:00:00 GMT", now), ShouldEqual, 0)
+			So(parseRetryAfter("soon", now), ShouldEqual, 0)
+			So(parseRetryAfter("", now), ShouldEqual, 0)
+		})
+
+		Convey("Test rejecting bad proxy", func() {
+			So(testFetcher.Init(&FetcherConfig{Proxy: "://bad"}), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestLinkResolving(t *testing.T) {
+	Convey("Test link resolving", t, func() {
+		base := DocumentBase("https://Example.com:443/blog/index.html", nil, false)
+
+		Convey("Test resolving relative links", func() {
+			So(ResolveLink(base, "/post/123", false), ShouldEqual, "https://example.com/post/123")
+			So(ResolveLink(base, "post/123", false), ShouldEqual, "https://example.com/blog/post/123")
+			So(ResolveLink(base, "//cdn.example.com/image.png", false), ShouldEqual, "https://cdn.example.com/image.png")
+			So(ResolveLink(base, "HTTP://Other.com:80/a", false), ShouldEqual, "http://other.com/a")
+			So(ResolveLink(base, "", false), ShouldEqual, "")
+			So(ResolveLink(nil, "/post/123", false), ShouldEqual, "/post/123")
+		})
+
+		Convey("Test honouring base href", func() {
+			content := []byte("<html><head><base href=\"/news/\"></head><body><base href=\"/ignored/\"></body></html>")
+			htmlBase := DocumentBase("https://example.com/index.html", content, true)
+			So(ResolveLink(htmlBase, "post/1", false), ShouldEqual, "https://example.com/news/post/1")
+			So(DocumentBase("https://example.com/feed", content, false).String(), ShouldEqual, "https://example.com/feed")
+		})
+
+		Convey("Test stripping tracking parameters", func() {
+			link := "/post/1?id=5&utm_source=rss&UTM_Medium=feed&fbclid=abc&page=2#comments"
+			So(ResolveLink(base, link, true), ShouldEqual, "https://example.com/post/1?id=5&page=2#comments")
+			So(ResolveLink(base, "/post/1?utm_source=rss", true), ShouldEqual, "https://example.com/post/1")
+			So(ResolveLink(base, link, false), ShouldEqual, "https://example.com"+link)
+		})
+
+		Convey("Test resolving links of parsed posts", func() {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("<html><head><base href=\"/hub/\"></head><body>" +
+					"<div class=\"post\"><a href=\"post/1?utm_campaign=x\">One</a><img src=\"/i/1.png\"><p>Text</p></div>" +
+					"</body></html>"))
+			}))
+			defer ts.Close()
+			rule, err := CompileRule(&Rule{
+				Kind:                SelectorRuleKind,
+				ItemPattern:         "div.post",
+				TitlePattern:        "a",
+				LinkPattern:         "a@href",
+				DescriptionPattern:  "p",
+				ImagePattern:        "img@src",
+				StripTrackingParams: true,
+			})
+			So(err, ShouldBeNil)
+			posts, err := GetContent(ts.URL+"/index.html", rule)
+			So(err, ShouldBeNil)
+			So(len(posts), ShouldEqual, 1)
+			So(posts[0].Link, ShouldEqual, ts.URL+"/hub/post/1")
+			So(posts[0].Image, ShouldEqual, ts.URL+"/i/1.png")
+		})
+	})
+}
+
+func TestChannelsUpdater(t *testing.T) {
+	Convey("Test channels updater", t, func() {
+		Convey("Test parsing updater config", func() {
+			config, err := ParseConfig(TestConfigPath)
+			So(err, ShouldBeNil)
+			So(config.UpdaterConfig.Workers, ShouldEqual, 4)
+			So(config.UpdaterConfig.DefaultRefreshInterval.Duration, ShouldEqual, time.Hour)
+			So(config.UpdaterConfig.InterChannelsDelay.Duration, ShouldEqual, time.Second*3)
+			So(config.UpdaterConfig.AdaptiveRefresh, ShouldBeTrue)
+			So(config.UpdaterConfig.MinRefreshInterval.Duration, ShouldEqual, time.Minute*5)
+
+			var updaterConfig UpdaterConfig
+			updaterConfig.setDefaults()
+			So(updaterConfig.WorkersPerHost, ShouldEqual, 1)
+			So(updaterConfig.FailuresToBreak, ShouldEqual, 3)
+			So(updaterConfig.TemporaryFailuresToBreak, ShouldEqual, 12)
+		})
+
+		Convey("Test interleaving channels by host", func() {
+			channels := []Channel{
+				{Name: "a1", Source: "https://a.com/1"},
+				{Name: "a2", Source: "https://a.com/2"},
+				{Name: "a3", Source: "https://a.com/3"},
+				{Name: "b1", Source: "https://b.com/1"},
+				{Name: "c1", Source: "http://c.com/1"},
+			}
+			var names []string
+			for _, channel := range interleaveByHost(channels) {
+				names = append(names, channel.Name)
+			}
+			So(names, ShouldResemble, []string{"a1", "b1", "c1", "a2", "a3"})
+		})
+
+		Convey("Test selecting due channels", func() {
+			now := time.Now()
+			past := now.Add(-time.Minute)
+			soon := now.Add(time.Second * 10)
+			later := now.Add(time.Hour)
+			channels := []Channel{
+				{Model: gorm.Model{ID: 1}},
+				{Model: gorm.Model{ID: 2}, NextUpdateAt: &past},
+				{Model: gorm.Model{ID: 3}, NextUpdateAt: &soon},
+				{Model: gorm.Model{ID: 4}, NextUpdateAt: &later},
+				{Model: gorm.Model{ID: 5}, NextUpdateAt: &past},
+			}
+
+			due, nextWakeup := dueChannels(channels, now, map[uint]bool{5: true})
+			So(len(due), ShouldEqual, 2)
+			So(due[0].ID, ShouldEqual, 1)
+			So(due[1].ID, ShouldEqual, 2)
+			So(nextWakeup, ShouldEqual, soon)
+
+			_, nextWakeup = dueChannels(channels[3:4], now, map[uint]bool{})
+			So(nextWakeup, ShouldEqual, now.Add(SchedulerMaxSleep))
+		})
+
+		Convey("Test choosing refresh interval", func() {
+			updater := ChannelsUpdater{DefaultRefreshInterval: time.Hour, MinRefreshInterval: time.Minute * 5, MaxRefreshInterval: time.Hour * 24}
+			So(updater.refreshInterval(&Channel{}), ShouldEqual, time.Hour)
+			So(updater.refreshInterval(&Channel{RefreshInterval: time.Minute * 5}), ShouldEqual, time.Minute*5)
+			So(updater.refreshInterval(&Channel{RefreshInterval: time.Minute * 5, AdaptiveInterval: time.Hour * 2}), ShouldEqual, time.Minute*5)
+
+			updater.AdaptiveRefresh = true
+			So(updater.refreshInterval(&Channel{RefreshInterval: time.Minute * 5, AdaptiveInterval: time.Hour * 2}), ShouldEqual, time.Hour*2)
+			So(updater.refreshInterval(&Channel{RefreshInterval: time.Minute * 5}), ShouldEqual, time.Minute*5)
+
+			weekly := Channel{RefreshInterval: time.Hour * 168, AdaptiveInterval: time.Minute * 5}
+			So(updater.refreshInterval(&weekly), ShouldEqual, time.Hour*168)
+			min, max := updater.adaptiveBounds(&weekly)
+			So(min, ShouldEqual, time.Hour*168)
+			So(max, ShouldEqual, time.Hour*168)
+			min, max = updater.adaptiveBounds(&Channel{RefreshInterval: time.Hour})
+			So(min, ShouldEqual, time.Hour)
+			So(max, ShouldEqual, time.Hour*24)
+		})
+
+		Convey("Test adapting refresh interval", func() {
+			min := time.Minute * 5
+			max := time.Hour * 24
+			So(adaptRefreshInterval(time.Hour, &FetchStats{ParsedCount: 20, NewCount: 0}, min, max), ShouldEqual, time.Minute*90)
+			So(adaptRefreshInterval(time.Hour, &FetchStats{ParsedCount: 20, NewCount: 20}, min, max), ShouldEqual, time.Minute*30)
+			So(adaptRefreshInterval(time.Hour, &FetchStats{ParsedCount: 20, NewCount: 3}, min, max), ShouldEqual, time.Hour)
+			So(adaptRefreshInterval(time.Hour*20, &FetchStats{ParsedCount: 20, NewCount: 0}, min, max), ShouldEqual, max)
+			So(adaptRefreshInterval(time.Minute*6, &FetchStats{ParsedCount: 20, NewCount: 20}, min, max), ShouldEqual, min)
+		})
+
+		Convey("Test channel health transitions", func() {
+			updater := ChannelsUpdater{FailuresToDegrade: 1, FailuresToBreak: 3, SuccessesToRecover: 2}
+			failure := errors.New("fetching error")
+
+			health := updater.nextChannelHealth(ChannelHealth{}, nil)
+			So(health.Health, ShouldEqual, ChannelHealthy)
+
+			health = updater.nextChannelHealth(health, failure)
+			So(health.Health, ShouldEqual, ChannelDegraded)
+			So(health.LastError, ShouldEqual, "fetching error")
+			health = updater.nextChannelHealth(health, failure)
+			So(health.Health, ShouldEqual, ChannelDegraded)
+			health = updater.nextChannelHealth(health, failure)
+			So(health.Health, ShouldEqual, ChannelBroken)
+			So(health.ConsecutiveFailures, ShouldEqual, 3)
+
+			health = updater.nextChannelHealth(health, nil)
+			So(health.Health, ShouldEqual, ChannelDegraded)
+			So(health.ConsecutiveFailures, ShouldEqual, 0)
+			So(health.LastError, ShouldEqual, "")
+			health = updater.nextChannelHealth(health, nil)
+			So(health.Health, ShouldEqual, ChannelHealthy)
+		})
+
+		Convey("Test temporary errors break channels only after many in a row", func() {
+			updater := ChannelsUpdater{FailuresToDegrade: 1, FailuresToBreak: 1, TemporaryFailuresToBreak: 3, SuccessesToRecover: 1}
+			temporaryErr := &FetchError{Message: "unexpected status 503", Temporary: true}
+
+			health := updater.nextChannelHealth(ChannelHealth{Health: ChannelHealthy}, temporaryErr)
+			So(health.Health, ShouldEqual, ChannelDegraded)
+			So(health.ConsecutiveFailures, ShouldEqual, 0)
+			So(health.ConsecutiveTemporaryFailures, ShouldEqual, 1)
+			So(health.LastError, ShouldEqual, "unexpected status 503")
+			health = updater.nextChannelHealth(health, temporaryErr)
+			So(health.Health, ShouldEqual, ChannelDegraded)
+			health = updater.nextChannelHealth(health, temporaryErr)
+			So(health.Health, ShouldEqual, ChannelBroken)
+			So(updater.brokenFailures(health), ShouldEqual, 1)
+			health = updater.nextChannelHealth(health, nil)
+			So(health.ConsecutiveTemporaryFailures, ShouldEqual, 0)
+
+			health = updater.nextChannelHealth(ChannelHealth{Health: ChannelBroken, ConsecutiveFailures: 4}, temporaryErr)
+			So(health.Health, ShouldEqual, ChannelBroken)
+			So(health.ConsecutiveFailures, ShouldEqual, 4)
+
+			health = updater.nextChannelHealth(ChannelHealth{Health: ChannelHealthy}, &FetchError{Message: "unexpected status 404"})
+			So(health.Health, ShouldEqual, ChannelBroken)
+		})
+
+		Convey("Test respecting Retry-After of failed updates", func() {
+			updater := ChannelsUpdater{
+				FailuresToBreak:        1,
+				BrokenRetryInterval:    time.Minute * 10,
+				MaxBrokenRetryInterval: time.Hour,
+			}
+			limitedErr := &FetchError{Message: "unexpected status 429", Temporary: true, RetryAfter: time.Hour * 2}
+			degraded := ChannelHealth{Health: ChannelDegraded, ConsecutiveTemporaryFailures: 1}
+			So(updater.failedUpdateInterval(time.Minute*5, degraded, limitedErr), ShouldEqual, time.Hour*2)
+			So(updater.failedUpdateInterval(time.Hour*3, degraded, limitedErr), ShouldEqual, time.Hour*3)
+
+			broken := ChannelHealth{Health: ChannelBroken, ConsecutiveFailures: 1}
+			So(updater.failedUpdateInterval(time.Minute*5, broken, limitedErr), ShouldEqual, time.Hour*2)
+			So(updater.failedUpdateInterval(time.Minute*5, broken, errors.New("parsing error")), ShouldEqual, time.Minute*10)
+		})
+
+		Convey("Test retrying broken channels with backoff", func() {
+			updater := ChannelsUpdater{
+				FailuresToBreak:        3,
+				BrokenRetryInterval:    time.Minute * 10,
+				MaxBrokenRetryInterval: time.Hour,
+			}
+			So(updater.brokenRetryInterval(3), ShouldEqual, time.Minute*10)
+			So(updater.brokenRetryInterval(4), ShouldEqual, time.Minute*20)
+			So(updater.brokenRetryInterval(5), ShouldEqual, time.Minute*40)
+			So(updater.brokenRetryInterval(6), ShouldEqual, time.Hour)
+			So(updater.brokenRetryInterval(100), ShouldEqual, time.Hour)
+
+			updater.TemporaryFailuresToBreak = 12
+			So(updater.brokenFailures(ChannelHealth{ConsecutiveFailures: 4, ConsecutiveTemporaryFailures: 5}), ShouldEqual, 4)
+			So(updater.brokenFailures(ChannelHealth{ConsecutiveFailures: 1, ConsecutiveTemporaryFailures: 13}), ShouldEqual, 4)
+		})
+
+		Convey("Test limiting concurrent requests per host", func() {
+			limiter := newHostLimiter(1)
+			limiter.acquire("a.com")
+			limiter.acquire("b.com")
+
+			acquired := make(chan bool)
+			go func() {
+				limiter.acquire("a.com")
+				acquired <- true
+			}()
+			isBlocked := true
+			select {
+			case <-acquired:
+				isBlocked = false
+			case <-time.After(50 * time.Millisecond):
+			}
+			So(isBlocked, ShouldBeTrue)
+
+			limiter.release("a.com")
+			So(<-acquired, ShouldBeTrue)
+		})
+	})
+}
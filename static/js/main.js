@@ -7,6 +7,10 @@ let brokenChannelContent = `
 <p class="text-lg-center" style="font-size: 40px">
     Oops! Looks like channel is broken due to invalid source or parsing rule.
 </p>
+<p class="text-lg-center">
+    The aggregator keeps retrying it and will restore the channel as soon as it gets updated successfully.
+</p>
+<button id="edit-btn" class="btn btn-outline-primary align-content-center" role="button">Edit this channel</button>
 <button id="delete-btn" class="btn btn-outline-danger align-content-center" role="button">Delete this channel</button>
 `;
 
@@ -30,6 +34,10 @@ function deleteChannel(channelId) {
     location.href = "/deletechannel/" + channelId;
 }
 
+function editChannel(channelId) {
+    location.href = "/editchannel/" + channelId;
+}
+
 function isBrokenChannel() {
     let channelId = getCurrentChannel();
     let link = $("#channel-" + channelId);
@@ -47,6 +55,8 @@ function activateChannelLink() {
         mainContent.html(brokenChannelContent);
         let dltButton = $("#delete-btn");
         dltButton.attr("onclick", "deleteChannel(" + channelId + ");");
+        let editButton = $("#edit-btn");
+        editButton.attr("onclick", "editChannel(" + channelId + ");");
     }
 }
 
@@ -79,6 +89,24 @@ function fillChannelContent() {
             link.innerHTML = post.Title;
             h.innerHTML = $(link).prop("outerHTML");
             div.innerHTML = post.Description;
+            let meta = [];
+            if (post.PublishedAt) {
+                meta.push(new Date(post.PublishedAt).toLocaleString());
+            }
+            if (post.Author) {
+                meta.push(post.Author);
+            }
+            if (meta.length > 0) {
+                let small = document.createElement("p");
+                small.className = "text-muted";
+                small.textContent = meta.join(" · ");
+                div.insertBefore(small, div.firstChild);
+            }
+            if (post.Image) {
+                let img = document.createElement("img");
+                img.setAttribute("src", post.Image);
+                div.insertBefore(img, div.firstChild);
+            }
             let hr = $(document.createElement("hr"));
             hr.addClass("hr-primary");
             mainContent.append(h);
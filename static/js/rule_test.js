@@ -0,0 +1,97 @@
+function appendText(parent, tag, text, className) {
+    let element = document.createElement(tag);
+    element.textContent = text;
+    if (className) {
+        element.className = className;
+    }
+    parent.append(element);
+    return element;
+}
+
+function renderPatterns(preview, patterns) {
+    let table = $(document.createElement("table"));
+    table.addClass("table table-sm");
+    let header = $(document.createElement("tr"));
+    ["Pattern", "Matched", "Failed items"].forEach(function (name) {
+        appendText(header, "th", name);
+    });
+    table.append(header);
+    Object.keys(patterns).forEach(function (name) {
+        let pattern = patterns[name];
+        let row = $(document.createElement("tr"));
+        if (pattern.FailedItems.length > 0) {
+            row.addClass("table-warning");
+        }
+        appendText(row, "td", name);
+        appendText(row, "td", pattern.Matched);
+        appendText(row, "td", pattern.FailedItems.join(", "));
+        table.append(row);
+    });
+    preview.append(table);
+}
+
+function renderPosts(preview, posts) {
+    posts.forEach(function (post) {
+        let h = $(document.createElement("h5"));
+        let link = appendText(h, "a", post.Title || post.Link);
+        link.setAttribute("href", post.Link);
+        preview.append(h);
+        let meta = [];
+        if (post.PublishedAt) {
+            meta.push(new Date(post.PublishedAt).toLocaleString());
+        }
+        if (post.Author) {
+            meta.push(post.Author);
+        }
+        if (meta.length > 0) {
+            appendText(preview, "p", meta.join(" · "), "text-muted");
+        }
+        let div = document.createElement("div");
+        div.innerHTML = post.Description;
+        preview.append(div);
+        preview.append(document.createElement("hr"));
+    });
+}
+
+function renderRuleTestResult(result) {
+    let preview = $("#rule-test-result");
+    preview.html("");
+    if (result.Error) {
+        appendText(preview, "div", result.Error, "alert alert-danger");
+    }
+    if (result.StatusCode) {
+        appendText(preview, "p", "Status " + result.StatusCode + ", " + result.BytesCount + " bytes, " +
+            result.ItemsCount + " items, " + result.Posts.length + " posts", "text-muted");
+    }
+    if (result.Patterns) {
+        renderPatterns(preview, result.Patterns);
+    }
+    if (result.Warnings) {
+        let list = $(document.createElement("ul"));
+        result.Warnings.forEach(function (warning) {
+            appendText(list, "li", warning, "text-warning");
+        });
+        preview.append(list);
+    }
+    renderPosts(preview, result.Posts);
+}
+
+function testRule() {
+    let form = document.getElementById("channel-form");
+    let preview = $("#rule-test-result");
+    preview.html("");
+    appendText(preview, "p", "Testing the rule...", "text-muted");
+    fetch("/testrule", {
+        method: "POST",
+        body: new URLSearchParams(new FormData(form))
+    }).then(function (response) {
+        return response.json();
+    }).then(renderRuleTestResult).catch(function (error) {
+        preview.html("");
+        appendText(preview, "div", "Testing error: " + error, "alert alert-danger");
+    });
+}
+
+$(document).ready(function () {
+    $("#test-rule-btn").on("click", testRule);
+});
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/antchfx/xmlquery"
+	"github.com/antchfx/xpath"
+	"strconv"
+	"strings"
+)
+
+func getContentByXPath(name string, item *xmlquery.Node, expr *xpath.Expr, asXml bool) (string, error) {
+	switch value := expr.Evaluate(xmlquery.CreateXPathNavigator(item)).(type) {
+	case *xpath.NodeIterator:
+		if !value.MoveNext() {
+			return "", errors.New(fmt.Sprintf("can not find %v by xpath", name))
+		}
+		navigator := value.Current().(*xmlquery.NodeNavigator)
+		if asXml && navigator.NodeType() == xpath.ElementNode {
+			return strings.TrimSpace(navigator.Current().OutputXML(false)), nil
+		}
+		return strings.TrimSpace(navigator.Value()), nil
+	case string:
+		return strings.TrimSpace(value), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	default:
+		return "", errors.New(fmt.Sprintf("unexpected %v xpath result type %T", name, value))
+	}
+}
+
+func getOptionalContentByXPath(name string, item *xmlquery.Node, expr *xpath.Expr) string {
+	if expr == nil {
+		return ""
+	}
+	value, err := getContentByXPath(name, item, expr, false)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+func parseXPathContent(rule *CompiledRule, content []byte) ([]Post, *ParseReport, error) {
+	document, err := xmlquery.Parse(bytes.NewReader(content))
+	if err != nil {
+		return nil, nil, errors.New("xml parsing error: " + err.Error())
+	}
+
+	items := xmlquery.QuerySelectorAll(document, rule.ItemXPath)
+	if len(items) == 0 {
+		return nil, nil, errors.New("can not find item by xpath")
+	}
+
+	return collectItems(rule, len(items), func(i int) *itemFields {
+		item := items[i]
+
+		var fields itemFields
+		fields.Title, fields.TitleErr = getContentByXPath("title", item, rule.TitleXPath, false)
+		fields.Link, fields.LinkErr = getContentByXPath("link", item, rule.LinkXPath, false)
+		fields.Description, fields.DescriptionErr = getContentByXPath("description", item, rule.DescriptionXPath, true)
+		fields.Meta = postMeta{
+			Date:   getOptionalContentByXPath("date", item, rule.DateXPath),
+			Author: getOptionalContentByXPath("author", item, rule.AuthorXPath),
+			GUID:   getOptionalContentByXPath("guid", item, rule.GUIDXPath),
+			Image:  getOptionalContentByXPath("image", item, rule.ImageXPath),
+		}
+		return &fields
+	})
+}